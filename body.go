@@ -0,0 +1,357 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// A rule may limit the size of request bodies, in which case a body whose
+// declared length exceeds the limit is refused with status 413 before the
+// script starts. A rule may also have bodies spooled, that is, read completely
+// before the script starts: small bodies are held in memory and larger ones in
+// a temporary file. A spooled body has a known length, so bodies sent with
+// chunked transfer encoding can be passed to scripts with CONTENT_LENGTH set.
+// Otherwise, such a body is passed to the script as it arrives, and the size
+// limit is enforced as it is read: a script whose body turns out to be too
+// large is killed before its input ends, and status 413 is returned if it has
+// not yet begun its response. A rule may also have compressed bodies decoded,
+// in which case they are spooled as well and the size limit applies to the
+// decoded body.
+
+// spoolMemDefault is the size above which spooled bodies are kept in a
+// temporary file rather than in memory, unless the rule specifies otherwise
+const spoolMemDefault = 1 << 20
+
+// errBodyTooLarge is reported when more of a request body is read than its
+// rule permits
+var errBodyTooLarge = errors.New("request body too large")
+
+// errResponseTooLarge is reported when a script writes more to its standard
+// output than its rule permits
+var errResponseTooLarge = errors.New("response too large")
+
+// limitReader passes along at most max bytes from rdr and reports err if rdr
+// has more. A max of zero imposes no limit.
+type limitReader struct {
+	rdr io.Reader
+	max int64
+	err error
+	n   int64
+}
+
+func (lr *limitReader) Read(p []byte) (n int, err error) {
+	switch {
+	case lr.max <= 0:
+		n, err = lr.rdr.Read(p)
+	case lr.exceeded():
+		err = lr.err
+	default:
+		// Read no more than one byte beyond the limit
+		if int64(len(p)) > lr.max+1-lr.n {
+			p = p[:lr.max+1-lr.n]
+		}
+		n, err = lr.rdr.Read(p)
+		lr.n += int64(n)
+		if lr.exceeded() {
+			n--
+			err = lr.err
+		}
+	}
+	return
+}
+
+// exceeded returns true if rdr has been found to hold more than max bytes
+func (lr *limitReader) exceeded() bool {
+	return lr.max > 0 && lr.n > lr.max
+}
+
+// streamReader passes a request body of unknown length to a script as the
+// script reads it. If the body exceeds the limit of the rule, the script is
+// killed before it can see the end of its input, so that it never takes a
+// truncated body for a complete one.
+type streamReader struct {
+	lr       limitReader
+	proc     chan *os.Process // receives the process of the script once started
+	tooLarge chan struct{}    // closed when the body is found to be too large
+	killed   bool
+}
+
+func newStreamReader(rdr io.Reader, max int64) *streamReader {
+	return &streamReader{lr: limitReader{rdr: rdr, max: max, err: errBodyTooLarge},
+		proc: make(chan *os.Process, 1), tooLarge: make(chan struct{})}
+}
+
+func (sr *streamReader) Read(p []byte) (n int, err error) {
+	n, err = sr.lr.Read(p)
+	if err == errBodyTooLarge && !sr.killed {
+		// The body is read only by the script's input, which is copied only
+		// after the process has started
+		sr.killed = true
+		close(sr.tooLarge)
+		(<-sr.proc).Kill()
+	}
+	return
+}
+
+// exceeded returns true if the body has been found to exceed the limit
+func (sr *streamReader) exceeded() (yes bool) {
+	select {
+	case <-sr.tooLarge:
+		yes = true
+	default:
+	}
+	return
+}
+
+// errBodyEncoding is reported when a request body has a content coding that
+// cannot be decoded
+var errBodyEncoding = errors.New("unsupported content encoding")
+
+// decodableCodings lists the content codings that can be undone, as
+// advertised in responses to bodies with other codings
+const decodableCodings = "gzip, deflate, br"
+
+// decodeMaxDefault limits the size of a decoded request body when the rule
+// does not set max_body_size, so that a small compressed body cannot expand
+// without bound
+const decodeMaxDefault = 16 << 20
+
+// bodyType is a request body as presented to a script
+type bodyType struct {
+	rdr     io.Reader     // standard input of script, or nil if there is no body
+	size    int64         // length of spooled body, or -1 if body is not spooled
+	fl      *os.File      // temporary file holding spooled body, or nil
+	decoded bool          // true if content coding of body has been undone
+	ctype   string        // replacement Content-Type of body, if not empty
+	env     []string      // extra environment variables that describe body
+	dir     string        // temporary directory holding uploaded files, or empty
+	stream  *streamReader // reader of body passed along as it arrives, or nil
+}
+
+// close releases the temporary file or directory, if any, that holds the
+// body
+func (body bodyType) close() {
+	if body.fl != nil {
+		body.fl.Close()
+		os.Remove(body.fl.Name())
+	}
+	if body.dir != "" {
+		os.RemoveAll(body.dir)
+	}
+}
+
+// exceeded returns true if the body is passed along as it arrives and has been
+// found to exceed the size limit of the rule
+func (body bodyType) exceeded() bool {
+	return body.stream != nil && body.stream.exceeded()
+}
+
+// request returns req, or a copy of it that reports the length of the body
+// if it has been spooled, that omits the Content-Encoding header if the body
+// has been decoded, and that reports the replacement Content-Type, if any
+func (body bodyType) request(req *http.Request) *http.Request {
+	if body.size >= 0 {
+		req = req.WithContext(req.Context())
+		req.ContentLength = body.size
+		req.TransferEncoding = nil
+		if body.decoded || body.ctype != "" {
+			hdr := make(http.Header, len(req.Header))
+			for k, v := range req.Header {
+				if k != "Content-Encoding" || !body.decoded {
+					hdr[k] = v
+				}
+			}
+			if body.ctype != "" {
+				hdr.Set("Content-Type", body.ctype)
+			}
+			req.Header = hdr
+		}
+	}
+	return req
+}
+
+// contentCodings returns the content codings, in the order in which they
+// were applied, of the body of req. Codings other than gzip, deflate and br
+// are reported with errBodyEncoding.
+func contentCodings(req *http.Request) (codings []string, err error) {
+	for _, str := range req.Header["Content-Encoding"] {
+		for _, coding := range strings.Split(str, ",") {
+			coding = strings.ToLower(trim(coding))
+			switch coding {
+			case "", "identity":
+			case "gzip", "x-gzip", "deflate", "br":
+				codings = append(codings, coding)
+			default:
+				err = errBodyEncoding
+			}
+		}
+	}
+	return
+}
+
+// decodeReader returns a reader of the data in src with the specified content
+// codings undone, last one first
+func decodeReader(src io.Reader, codings []string) (rdr io.Reader, err error) {
+	rdr = src
+	for j := len(codings) - 1; j >= 0 && err == nil; j-- {
+		var zr io.Reader
+		switch codings[j] {
+		case "deflate":
+			zr, err = zlib.NewReader(rdr)
+		case "br":
+			zr = brotli.NewReader(rdr)
+		default:
+			zr, err = gzip.NewReader(rdr)
+		}
+		if err == nil {
+			rdr = zr
+		}
+	}
+	return
+}
+
+// spoolBody reads src completely into memory or, if it is longer than the
+// spooling threshold, into a temporary file
+func (hst hostType) spoolBody(src io.Reader) (body bodyType, err error) {
+	var buf bytes.Buffer
+	memMax := hst.spoolMem
+	if memMax <= 0 {
+		memMax = spoolMemDefault
+	}
+	body.size, err = io.CopyN(&buf, src, memMax+1)
+	if err == io.EOF {
+		err = nil
+		body.rdr = bytes.NewReader(buf.Bytes())
+	} else if err == nil {
+		body.fl, err = ioutil.TempFile("", "cgi-body-")
+		if err == nil {
+			var n int64
+			body.size, err = buf.WriteTo(body.fl)
+			if err == nil {
+				n, err = io.Copy(body.fl, src)
+				body.size += n
+				if err == nil {
+					_, err = body.fl.Seek(0, io.SeekStart)
+					body.rdr = body.fl
+				}
+			}
+		}
+	}
+	return
+}
+
+// prepareBody checks the body of req against the size limit of the rule and,
+// if the rule or spool asks for it, spools it. A body of unknown length that
+// is not spooled is limited as the script reads it. If the rule asks for it, a compressed body is decoded as it is spooled
+// and a multipart/form-data body is received in place of the script. The
+// request parameters that the rule asks to have decoded, including the fields
+// of a URL-encoded form body, are added to the environment of body. If the
+// body cannot be accepted, a response is written to w, the outcome is
+// recorded in run, and ok is false. Otherwise, the caller must close body.
+func (hst hostType) prepareBody(w http.ResponseWriter, req *http.Request, run *runType,
+	spool bool) (body bodyType, ok bool) {
+	var err error
+	var codings []string
+	body.size = -1
+	chunked := req.ContentLength < 0 ||
+		(len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked")
+	if hst.decode {
+		codings, err = contentCodings(req)
+	}
+	boundary, upload := uploadBoundary(req)
+	upload = upload && hst.uploads != ""
+	form := hst.params.formBody(req) && (req.Header.Get("Content-Encoding") == "" || hst.decode)
+	spool = spool || hst.spool || len(codings) > 0 || upload || form
+	switch {
+	case err != nil:
+	case hst.maxBody > 0 && req.ContentLength > hst.maxBody:
+		err = errBodyTooLarge
+	case req.ContentLength == 0:
+	case spool:
+		var src io.Reader = req.Body
+		max := hst.maxBody
+		if len(codings) > 0 {
+			src, err = decodeReader(src, codings)
+			if max <= 0 {
+				max = decodeMaxDefault
+			}
+		}
+		if err == nil {
+			src = &limitReader{rdr: src, max: max, err: errBodyTooLarge}
+			if upload {
+				body, err = hst.receiveUploads(src, boundary)
+			} else {
+				body, err = hst.spoolBody(src)
+			}
+			body.decoded = len(codings) > 0
+			run.bytesIn = body.size
+		}
+	case chunked && hst.maxBody > 0:
+		body.stream = newStreamReader(countReader{rdr: req.Body, count: &run.bytesIn}, hst.maxBody)
+		body.rdr = body.stream
+	default:
+		body.rdr = countReader{rdr: req.Body, count: &run.bytesIn}
+	}
+	ok = err == nil
+	if ok && len(hst.params.sources) > 0 {
+		var values url.Values
+		ctype := body.ctype
+		if ctype == "" {
+			ctype = req.Header.Get("Content-Type")
+		}
+		if hst.params.decodes("form") && formType(ctype) &&
+			(req.Header.Get("Content-Encoding") == "" || body.decoded) {
+			values = formValues(body.rdr, body.size)
+		}
+		body.env = append(paramEnv(hst.params, req, values), body.env...)
+	}
+	if !ok {
+		body.close()
+		switch err {
+		case errBodyTooLarge:
+			run.status = http.StatusRequestEntityTooLarge
+			w.WriteHeader(run.status)
+			w.Write([]byte("Request body too large.\n"))
+		case errBodyEncoding:
+			run.status = http.StatusUnsupportedMediaType
+			w.Header().Set("Accept-Encoding", decodableCodings)
+			w.WriteHeader(run.status)
+			w.Write([]byte("Request body content encoding not supported.\n"))
+		case errTooManyFiles:
+			run.status = http.StatusRequestEntityTooLarge
+			w.WriteHeader(run.status)
+			w.Write([]byte("Too many files uploaded.\n"))
+		default:
+			hst.logf("cgi: cannot spool request body: %s", err)
+			run.status = http.StatusBadRequest
+			w.WriteHeader(run.status)
+		}
+	}
+	return
+}
@@ -19,22 +19,63 @@ package cgi
 import (
 	"bytes"
 	"errors"
+	"log"
 	"net/http"
-	"net/http/cgi"
+	"net/url"
 	"os"
+	"os/user"
 	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
 )
 
+// globMatch reports whether name matches the glob pattern. The notation is
+// that of path/Match, extended so that a path element consisting solely of
+// "**" matches zero or more elements of name.
+func globMatch(pattern, name string) (ok bool, err error) {
+	if strings.Contains(pattern, "**") {
+		ok, err = globMatchList(strings.Split(pattern, "/"), strings.Split(name, "/"))
+	} else {
+		ok, err = path.Match(pattern, name)
+	}
+	return
+}
+
+// globMatchList reports whether the path elements in names match the pattern
+// elements in pats
+func globMatchList(pats, names []string) (ok bool, err error) {
+	switch {
+	case len(pats) == 0:
+		ok = len(names) == 0
+	case pats[0] == "**":
+		for len(pats) > 1 && pats[1] == "**" {
+			pats = pats[1:]
+		}
+		for j := 0; j <= len(names) && !ok && err == nil; j++ {
+			ok, err = globMatchList(pats[1:], names[j:])
+		}
+	case len(names) > 0:
+		ok, err = path.Match(pats[0], names[0])
+		if ok {
+			ok, err = globMatchList(pats[1:], names[1:])
+		}
+	}
+	return
+}
+
 // match returns true if the request string (reqStr) matches the pattern string
 // (patternStr), false otherwise. If true is returned, it is followed by the
 // prefix that matches the pattern and the unmatched portion to its right.
-// patternStr uses glob notation; see path/Match for matching details. If the
-// pattern is invalid (for example, contains an unpaired "["), false is
-// returned.
+// patternStr uses glob notation; see globMatch for matching details. The
+// longest prefix that ends at an element boundary and matches the pattern is
+// chosen. If the pattern is invalid (for example, contains an unpaired "["),
+// false is returned.
 func match(requestStr string, patterns []string) (ok bool, prefixStr, suffixStr string) {
 	var str, last string
 	var err error
@@ -44,7 +85,7 @@ func match(requestStr string, patterns []string) (ok bool, prefixStr, suffixStr
 		str = requestStr
 		last = ""
 		for last != str && !ok && err == nil {
-			ok, err = path.Match(pattern, str)
+			ok, err = globMatch(pattern, str)
 			if err == nil {
 				if ok {
 					prefixStr = str
@@ -59,9 +100,133 @@ func match(requestStr string, patterns []string) (ok bool, prefixStr, suffixStr
 	return
 }
 
+// regexpSplit returns the position in reqStr at which the script portion of
+// a match, described by loc as returned by FindStringSubmatchIndex, ends. If
+// the expression has a group named "path_info", this is where that group
+// begins, or where the match ends if the group does not participate.
+// Otherwise, if the match extends to the end of reqStr, it is where the first
+// capture group that extends there begins, or the slash that precedes it,
+// provided that the remainder then begins with a slash and the script portion
+// is not empty. Otherwise, it is where the match ends.
+func regexpSplit(reqStr string, re *regexp.Regexp, loc []int) (pos int) {
+	pos = -1
+	named := false
+	for k, name := range re.SubexpNames() {
+		if name == "path_info" {
+			named = true
+			pos = loc[2*k]
+		}
+	}
+	if !named && loc[1] == len(reqStr) {
+		found := false
+		for k := 1; k < len(loc)/2 && !found; k++ {
+			found = loc[2*k] >= 0 && loc[2*k+1] == loc[1]
+			if found {
+				start := loc[2*k]
+				if start > 0 && !strings.HasPrefix(reqStr[start:], "/") && reqStr[start-1] == '/' {
+					start--
+				}
+				if start > 0 && strings.HasPrefix(reqStr[start:], "/") {
+					pos = start
+				}
+			}
+		}
+	}
+	if pos < 0 {
+		pos = loc[1]
+	}
+	return
+}
+
+// matchRegexp returns true if the request string (reqStr) matches any of the
+// regular expressions in list, false otherwise. If true is returned, it is
+// followed by the script portion of the request and the portion to its right,
+// as split by regexpSplit, and by the name and value of each named capture
+// group.
+func matchRegexp(reqStr string, list []*regexp.Regexp) (ok bool, prefixStr, suffixStr string, caps [][2]string) {
+	for j := 0; j < len(list) && !ok; j++ {
+		re := list[j]
+		loc := re.FindStringSubmatchIndex(reqStr)
+		if loc != nil {
+			ok = true
+			for k, name := range re.SubexpNames() {
+				if name != "" {
+					var val string
+					if loc[2*k] >= 0 {
+						val = reqStr[loc[2*k]:loc[2*k+1]]
+					}
+					caps = append(caps, [2]string{name, val})
+				}
+			}
+			pos := regexpSplit(reqStr, re, loc)
+			prefixStr = reqStr[:pos]
+			suffixStr = reqStr[pos:]
+		}
+	}
+	return
+}
+
+// matchType describes how a request satisfies a rule
+type matchType struct {
+	prefix string      // portion of the request path that matched
+	suffix string      // portion of the request path that follows prefix
+	caps   [][2]string // named groups captured by a regular expression
+	conds  []kvType    // method, host, header and query conditions that were met
+	spec   int         // specificity of the pattern or expression that matched
+	script string      // script file, if determined by the request path
+	ext    *extType    // interpreter of script, if mapped by its extension
+	// True if the request names a directory without a trailing slash
+	redirect bool
+	// Owner of a userdir script and the attributes of its process, or nil if
+	// the script may not be run
+	user *user.User
+	attr *syscall.SysProcAttr
+}
+
+// ruleMatch returns true if the request, with normalized path reqStr,
+// satisfies rule, false otherwise. If true is returned, it is followed by the
+// details of the match.
+func (h handlerType) ruleMatch(r *http.Request, reqStr string, rule ruleType) (ok bool, m matchType) {
+	matchStr := reqStr
+	if rule.ignoreCase {
+		matchStr = lowerASCII(reqStr)
+	}
+	for j := 0; j < len(rule.matches) && !ok; j++ {
+		var prefixStr string
+		ok, prefixStr, _ = match(matchStr, rule.matches[j:j+1])
+		if ok {
+			m.prefix, m.suffix = reqStr[:len(prefixStr)], reqStr[len(prefixStr):]
+			m.spec = specificity(rule.matches[j])
+		}
+	}
+	if !ok && rule.binDir != "" {
+		ok, m = matchCgiBin(reqStr, matchStr, rule)
+	}
+	if !ok && rule.userDir != "" {
+		ok, m = matchUserdir(reqStr, matchStr, rule)
+	}
+	if !ok && len(rule.exts) > 0 {
+		ok, m = matchHandler(h.root, reqStr, rule)
+	}
+	for j := 0; j < len(rule.regexps) && !ok; j++ {
+		ok, m.prefix, m.suffix, m.caps = matchRegexp(reqStr, rule.regexps[j:j+1])
+		if ok {
+			prefix, _ := rule.regexps[j].LiteralPrefix()
+			m.spec = len(prefix)
+		}
+	}
+	if ok {
+		ok = !excluded(matchStr, rule.exceptions)
+		if ok {
+			ok, m.conds = conditionsMatch(r, rule)
+		}
+	}
+	return
+}
+
 // excluded returns true if the request string (reqStr) matches any of the
 // pattern strings (patterns), false otherwise. patterns use glob notation; see
-// path/Match for matching details. If the pattern is invalid (for example,
+// globMatch for matching details. If the pattern is invalid (for example,
 // contains an unpaired "["), false is returned.
 func excluded(reqStr string, patterns []string) (ok bool) {
 	var err error
@@ -69,7 +234,7 @@ func excluded(reqStr string, patterns []string) (ok bool) {
 
 	ln := len(patterns)
 	for j := 0; j < ln && !ok; j++ {
-		match, err = path.Match(patterns[j], reqStr)
+		match, err = globMatch(patterns[j], reqStr)
 		if err == nil {
 			if match {
 				ok = true
@@ -99,69 +264,284 @@ func passAll() (list []string) {
 }
 
 // setupCall instantiates a CGI handler based on the incoming request and the
-// configuration rule that it matches.
-func setupCall(h handlerType, rule ruleType, lfStr, rtStr string,
-	rep httpserver.Replacer, hdr http.Header, username string) (cgiHnd cgi.Handler) {
-	cgiHnd.Root = "/"
-	cgiHnd.Dir = h.root
+// configuration rule that it matches. Each named group captured by a regular
+// expression match is available as placeholder {re.name} and is passed to the
+// application in RE_NAME. reqID is passed to the application in REQUEST_ID if
+// it is not empty.
+func setupCall(h handlerType, rule ruleType, m matchType,
+	rep httpserver.Replacer, hdr http.Header, username, reqID string) (cgiHnd hostType) {
+	cgiHnd.root = "/"
+	cgiHnd.dir = h.root
 	rep.Set("root", h.root)
-	rep.Set("match", lfStr)
+	rep.Set("match", m.prefix)
 	rep.Set(".", currentDir())
-	cgiHnd.Path = rep.Replace(rule.exe)
+	for _, kv := range m.caps {
+		rep.Set("re."+kv[0], kv[1])
+	}
+	cgiHnd.path = rep.Replace(rule.exe)
+	scriptStr := cgiHnd.path
+	if m.script != "" {
+		scriptStr = m.script
+		if m.ext == nil {
+			cgiHnd.path = m.script
+		} else {
+			cgiHnd.path = rep.Replace(m.ext.exe)
+		}
+	}
+	if m.user != nil {
+		cgiHnd.dir = filepath.Dir(m.script)
+		cgiHnd.attr = m.attr
+	}
 	if rule.dir != "" {
-		cgiHnd.Dir = rule.dir
+		cgiHnd.dir = rep.Replace(rule.dir)
+	}
+	cgiHnd.env = append(cgiHnd.env, "REMOTE_USER="+username)
+	if reqID != "" {
+		cgiHnd.env = append(cgiHnd.env, "REQUEST_ID="+reqID)
+	}
+	for _, kv := range m.caps {
+		cgiHnd.env = append(cgiHnd.env, "RE_"+strings.Map(upperCaseAndUnderscore, kv[0])+"="+kv[1])
 	}
-	cgiHnd.Env = append(cgiHnd.Env, "REMOTE_USER="+username)
 	envAdd := func(key, val string) {
 		val = rep.Replace(val)
-		cgiHnd.Env = append(cgiHnd.Env, key+"="+val)
+		cgiHnd.env = append(cgiHnd.env, key+"="+val)
 	}
 	for _, env := range rule.envs {
 		envAdd(env[0], env[1])
 	}
 	for _, env := range rule.emptyEnvs {
-		cgiHnd.Env = append(cgiHnd.Env, env+"=")
+		cgiHnd.env = append(cgiHnd.env, env+"=")
 	}
-	envAdd("PATH_INFO", rtStr)
-	envAdd("SCRIPT_FILENAME", cgiHnd.Path)
-	envAdd("SCRIPT_NAME", lfStr)
+	envAdd("PATH_INFO", m.suffix)
+	envAdd("SCRIPT_FILENAME", scriptStr)
+	envAdd("SCRIPT_NAME", m.prefix)
 	if rule.passAll {
-		cgiHnd.InheritEnv = passAll()
+		cgiHnd.inheritEnv = passAll()
+	} else {
+		cgiHnd.inheritEnv = append(cgiHnd.inheritEnv, rule.passEnvs...)
+	}
+	args := rule.args
+	if m.ext != nil {
+		args = m.ext.args
+	}
+	for _, str := range args {
+		cgiHnd.args = append(cgiHnd.args, rep.Replace(str))
+	}
+	if m.ext != nil {
+		cgiHnd.args = append(cgiHnd.args, m.script)
+	}
+	envAdd("SCRIPT_EXEC", trim(sprintf("%s %s", cgiHnd.path, join(cgiHnd.args, " "))))
+	cgiHnd.timing = rule.timing
+	cgiHnd.timingAll = rule.timingAll
+	cgiHnd.fall = rule.fallThrough
+	cgiHnd.fallOn = rule.fallStatuses
+	cgiHnd.sendDirs = rule.sendDirs
+	cgiHnd.accels = rule.accels
+	cgiHnd.nph = rule.nph || strings.HasPrefix(filepath.Base(scriptStr), "nph-")
+	cgiHnd.maxBody = rule.maxBody
+	cgiHnd.spool = rule.spool
+	cgiHnd.spoolMem = rule.spoolMem
+	cgiHnd.decode = rule.decodeBody
+	cgiHnd.uploads = rule.uploads
+	cgiHnd.maxFiles = rule.uploadFiles
+	cgiHnd.maxUpload = rule.uploadMax
+	cgiHnd.maxResp = rule.maxResponse
+	cgiHnd.timeout = rule.timeout
+	if len(rule.params) > 0 {
+		cgiHnd.params = newParams(rule)
+	}
+	return
+}
+
+// ruleLabel returns the string used to identify rule in placeholders, spans
+// and log messages. This is the rule's name if one was given, otherwise its
+// match patterns, cgi_bin prefix, handled extensions and expressions.
+func ruleLabel(rule ruleType) (str string) {
+	str = rule.name
+	if str == "" {
+		list := rule.matches
+		if rule.binDir != "" {
+			list = append(list[:len(list):len(list)], rule.binPrefix+"/")
+		}
+		if rule.userDir != "" {
+			list = append(list[:len(list):len(list)], "/~*"+rule.userPrefix+"/")
+		}
+		for _, ext := range rule.exts {
+			list = append(list[:len(list):len(list)], "*"+ext.ext)
+		}
+		for _, re := range rule.regexps {
+			list = append(list[:len(list):len(list)], re.String())
+		}
+		str = join(list, " ")
+	}
+	return
+}
+
+// acquireSlot waits until fewer processes of rule are running than it
+// permits, counting the request as queued in the metrics while it waits. ok
+// is false if the client goes away first; a slot that is acquired must be
+// released by receiving from rule.slots.
+func acquireSlot(r *http.Request, rule ruleType, label string) (ok bool) {
+	ok = rule.slots == nil
+	if !ok {
+		metrics.wait(label, 1)
+		select {
+		case rule.slots <- struct{}{}:
+			ok = true
+		case <-r.Context().Done():
+		}
+		metrics.wait(label, -1)
+	}
+	return
+}
+
+// setRunPlaceholders makes the details of a completed CGI execution available
+// as placeholders to subsequent middleware such as the access log. Values that
+// are not known are left unset so that the consumer's empty value is used.
+func setRunPlaceholders(rep httpserver.Replacer, rule ruleType, cgiHnd hostType, run *runType) {
+	rep.Set("cgi.rule", ruleLabel(rule))
+	rep.Set("cgi.exec", cgiHnd.path)
+	if !run.start.IsZero() {
+		rep.Set("cgi.duration", run.duration.Round(time.Microsecond).String())
+	}
+	if state := run.state; state != nil {
+		rep.Set("cgi.pid", strconv.Itoa(state.Pid()))
+		rep.Set("cgi.exit_code", strconv.Itoa(state.ExitCode()))
+		if sig := processSignal(state); sig != "" {
+			rep.Set("cgi.signal", sig)
+		}
+		rep.Set("cgi.user_cpu", state.UserTime().Round(time.Microsecond).String())
+		rep.Set("cgi.sys_cpu", state.SystemTime().Round(time.Microsecond).String())
+		if rss := processMaxRSS(state); rss > 0 {
+			rep.Set("cgi.max_rss", strconv.FormatInt(rss, 10))
+		}
+	}
+}
+
+// execute responds to a request that has matched the specified rule as
+// described by m. The details of the execution are returned; if the script's
+// response was discarded, the caller is responsible for responding. Anything
+// the CGI application writes to its standard error stream is returned as an
+// error.
+func (h handlerType) execute(w http.ResponseWriter, r *http.Request, rule ruleType,
+	m matchType, rep httpserver.Replacer) (run runType, err error) {
+	var buf bytes.Buffer
+	var reqID string
+
+	// Retrieve name of remote user that was set by some downstream middleware,
+	// possibly basicauth.
+	remoteUser, _ := r.Context().Value(httpserver.RemoteUserCtxKey).(string) // Blank if not set
+	if h.requestIDHeader != "" {
+		reqID = requestID(r, h.requestIDHeader)
+		rep.Set("cgi.request_id", reqID)
+		w.Header().Set(h.requestIDHeader, reqID)
+	}
+	cgiHnd := setupCall(h, rule, m, rep, r.Header, remoteUser, reqID)
+	cgiHnd.stderr = &syncWriter{w: &buf}
+	cgiHnd.env = append(cgiHnd.env, redirectEnv(r)...)
+	if rule.inspect {
+		inspect(cgiHnd, m.conds, w, r, rep)
 	} else {
-		cgiHnd.InheritEnv = append(cgiHnd.InheritEnv, rule.passEnvs...)
+		var span spanType
+		label := rule.name // rules without a name are not recorded in the metrics
+		if h.tracer != nil {
+			span = startSpan(r, "cgi "+ruleLabel(rule))
+			cgiHnd.env = append(cgiHnd.env, span.traceEnv()...)
+		}
+		if acquireSlot(r, rule, label) {
+			metrics.begin(label)
+			if cgiHnd.nph {
+				run = cgiHnd.serveNPH(w, r)
+			} else if rule.debug && debugAllowed(rule.debugNets, r.RemoteAddr) {
+				run = debugServe(cgiHnd, w, r)
+			} else {
+				run = cgiHnd.serve(w, r)
+			}
+			metrics.end(label, &run)
+			if rule.slots != nil {
+				<-rule.slots
+			}
+		} else {
+			// The client went away while the request waited for a process slot
+			run.status = http.StatusServiceUnavailable
+			w.WriteHeader(run.status)
+		}
+		if h.tracer != nil {
+			span.finish(r, rule, cgiHnd, &run)
+			if reqID != "" {
+				span.attrs = append(span.attrs, attrType{"cgi.request_id", reqID})
+			}
+			h.tracer.export(span)
+		}
+	}
+	setRunPlaceholders(rep, rule, cgiHnd, &run)
+	if buf.Len() > 0 {
+		str := trim(buf.String())
+		if reqID != "" {
+			str = prefixLines(str, "["+reqID+"] ")
+		}
+		err = errors.New(str)
 	}
-	for _, str := range rule.args {
-		cgiHnd.Args = append(cgiHnd.Args, rep.Replace(str))
+	return
+}
+
+// find returns the rule that handles the request with normalized path reqStr.
+// This is the first rule, in priority and configuration order, that the
+// request satisfies or, in specificity order, the rule among those of the
+// highest priority whose matching pattern is most specific. ok is false if
+// there is no such rule.
+func (h handlerType) find(r *http.Request, reqStr string) (ok bool, rule ruleType, m matchType) {
+	list := h.index.candidates(reqStr, len(h.rules))
+	for j := 0; j < len(list) && (!ok || h.specific); j++ {
+		next := h.rules[list[j]]
+		if !ok || next.priority == rule.priority {
+			found, nm := h.ruleMatch(r, reqStr, next)
+			if found && (!ok || nm.spec > m.spec) {
+				ok, rule, m = true, next, nm
+			}
+		}
 	}
-	envAdd("SCRIPT_EXEC", trim(sprintf("%s %s", cgiHnd.Path, join(cgiHnd.Args, " "))))
 	return
 }
 
 // ServeHTTP satisfies the httpserver.Handler interface.
 func (h handlerType) ServeHTTP(w http.ResponseWriter, r *http.Request) (code int, err error) {
-	rep := httpserver.NewReplacer(r, nil, "")
-	for _, rule := range h.rules {
-		ok, lfStr, rtStr := match(r.URL.Path, rule.matches)
-		if ok {
-			ok = !excluded(r.URL.Path, rule.exceptions)
-			if ok {
-				var buf bytes.Buffer
-				// Retrieve name of remote user that was set by some downstream middleware,
-				// possibly basicauth.
-				remoteUser, _ := r.Context().Value(httpserver.RemoteUserCtxKey).(string) // Blank if not set
-				cgiHnd := setupCall(h, rule, lfStr, rtStr, rep, r.Header, remoteUser)
-				cgiHnd.Stderr = &buf
-				if rule.inspect {
-					inspect(cgiHnd, w, r, rep)
-				} else {
-					cgiHnd.ServeHTTP(w, r)
+	if h.metricsPath != "" && r.URL.Path == h.metricsPath {
+		metrics.ServeHTTP(w, r)
+		return
+	}
+	reqStr, err := normalizePath(r)
+	ok, rule, m := h.find(r, reqStr)
+	if ok {
+		switch {
+		case err != nil:
+			code = http.StatusBadRequest
+		case m.redirect:
+			target := (&url.URL{Path: m.prefix + "/", RawQuery: r.URL.RawQuery}).String()
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+		case rule.binDir != "" && !executable(m.script):
+			code = http.StatusNotFound
+		case rule.userDir != "" && m.attr == nil:
+			code = http.StatusNotFound
+		default:
+			var run runType
+			rep := httpserver.NewReplacer(r, nil, "")
+			run, err = h.execute(w, r, rule, m, rep)
+			if run.discarded() {
+				if err != nil {
+					log.Printf("[ERROR] cgi: %s", err)
 				}
-				if buf.Len() > 0 {
-					err = errors.New(trim(buf.String()))
+				switch {
+				case run.fell:
+					code, err = h.next.ServeHTTP(w, r)
+				case run.unsent:
+					code, err = run.status, nil
+				default:
+					code, err = h.localRedirect(w, r, run.location)
 				}
-				return
 			}
 		}
+		return
 	}
 	return h.next.ServeHTTP(w, r)
 }
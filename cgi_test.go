@@ -2,14 +2,30 @@ package cgi
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
 )
@@ -45,6 +61,36 @@ func handlerGet(directiveStr, rootStr string) (hnd handlerType, err error) {
 	return
 }
 
+// caddyGet returns a Caddy server for host 127.0.0.1 whose middleware is
+// configured by the specified directive string, so that responses pass
+// through the same recovery and error handling as in a deployment
+func caddyGet(directiveStr, rootStr string) (srv *httpserver.Server, err error) {
+	c := caddy.NewTestController("http", directiveStr)
+	cfg := httpserver.GetConfig(c)
+	cfg.Root = rootStr
+	cfg.Addr = httpserver.Address{Original: "127.0.0.1", Host: "127.0.0.1"}
+	err = configureServer(c, cfg)
+	if err == nil {
+		srv, err = httpserver.NewServer("127.0.0.1:0", []*httpserver.SiteConfig{cfg})
+	}
+	return
+}
+
+// metricSample returns the value of the sample named by key, such as
+// cgi_executions_total{rule="x"}, in the current metrics, or zero if the
+// sample is not reported. Since the metrics are kept for the whole process,
+// tests compare samples taken before and after the requests they make.
+func metricSample(key string) (val float64) {
+	var buf bytes.Buffer
+	metrics.write(&buf)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, key+" ") {
+			val, _ = strconv.ParseFloat(line[len(key)+1:], 64)
+		}
+	}
+	return
+}
+
 func TestServe(t *testing.T) {
 	var err error
 	var code int
@@ -238,42 +284,107 @@ dir /tmp
 	}
 }
 
-func TestPassAll(t *testing.T) {
+func TestCgiBin(t *testing.T) {
 	var err error
-	var code int
 	var hnd handlerType
-	var srv *httptest.Server
-	request := `/full`
-	directive := `cgi {
-match /full
-exec {.}/test/fullenv
-pass_all_env
-}`
 
-	// Testing the ServeHTTP method requires OS-specific CGI scripts, because a
-	// system call is made to respond to the request.
-	if runtime.GOOS == "linux" {
-		var buf bytes.Buffer
+	directive := `cgi cgi_bin /cgi-bin ./test`
+	// [request, expected status, expected text in response]
+	list := [][]string{
+		{"/cgi-bin/fullenv/a/b", "0", "SCRIPT_NAME=/cgi-bin/fullenv\n"},
+		{"/cgi-bin/fullenv/a/b", "0", "PATH_INFO=/a/b\n"},
+		{"/cgi-bin/fullenv", "0", "SCRIPT_FILENAME=" + currentDir() + "/test/fullenv\n"},
+		{"/cgi-bin/example.txt", "404", ""},
+		{"/cgi-bin/missing/a", "404", ""},
+		{"/cgi-bin/", "404", ""},
+		{"/cgi-bin", "0", ""},
+		{"/cgi-bin/../test/fullenv", "0", ""},
+		{"/cgi-bin/..%5Ctest%5Cfullenv", "404", ""},
+		{"/cgi-bin/a%5C..%5C..%5Ctest%5Cfullenv/b", "404", ""},
+	}
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
 		hnd, err = handlerGet(directive, "./test")
+		for j := 0; j < len(list) && err == nil; j++ {
+			var code int
+			rec := list[j]
+			rsp := httptest.NewRecorder()
+			code, err = hnd.ServeHTTP(rsp, httptest.NewRequest("GET", rec[0], nil))
+			if err == nil {
+				str := rsp.Body.String()
+				if sprintf("%d", code) != rec[1] || !strings.Contains(str, rec[2]) || (rec[2] == "" && str != "") {
+					err = fmt.Errorf("unexpected response to %s: %d, %s", rec[0], code, str)
+				}
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var rootStr, outStr string
+
+	script := "#!/bin/sh\nprintf 'Content-type: text/plain\\n\\n'\n/usr/bin/env\n"
+	// [request, expected text in response, or empty if request falls through]
+	list := [][]string{
+		{"/hello.sh/extra", "SCRIPT_NAME=/hello.sh\n"},
+		{"/hello.sh/extra", "PATH_INFO=/extra\n"},
+		{"/hello.sh", "SCRIPT_FILENAME={root}/hello.sh\n"},
+		{"/sub/inner.sh", "SCRIPT_NAME=/sub/inner.sh\n"},
+		{"/missing.sh", ""},
+		{"/hello.txt", ""},
+		{"/hello.txt/inner.sh", ""},
+		{"/link.sh", ""},
+		{"/sub", ""},
+		{"/", ""},
+	}
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		rootStr, err = ioutil.TempDir("", "cgi")
 		if err == nil {
-			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				code, err = hnd.ServeHTTP(w, r)
-				if err != nil {
-					fmt.Fprintf(&buf, "code [%d], error [%s]\n", code, err)
+			defer os.RemoveAll(rootStr)
+			outStr, err = ioutil.TempDir("", "cgi")
+			if err == nil {
+				defer os.RemoveAll(outStr)
+			}
+		}
+		for _, fileStr := range []string{"hello.sh", "hello.txt", "sub/inner.sh"} {
+			if err == nil {
+				fileStr = filepath.Join(rootStr, fileStr)
+				err = os.MkdirAll(filepath.Dir(fileStr), 0755)
+				if err == nil {
+					err = ioutil.WriteFile(fileStr, []byte(script), 0644)
 				}
-			}))
-			fmt.Fprintf(&buf, "=== Directive ===\n%s\n", directive)
-			var res *http.Response
-			fmt.Fprintf(&buf, "--- Request %s ---\n", request)
-			res, err = http.Get(srv.URL + request)
+			}
+		}
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(outStr, "out.sh"), []byte(script), 0644)
 			if err == nil {
-				_, err = buf.ReadFrom(res.Body)
-				res.Body.Close()
+				err = os.Symlink(filepath.Join(outStr, "out.sh"), filepath.Join(rootStr, "link.sh"))
 			}
-			srv.Close()
 		}
 		if err == nil {
-			err = checkEnv(buf.String())
+			hnd, err = handlerGet("cgi handler .sh /bin/sh", rootStr)
+			if err == nil {
+				rootStr = hnd.root
+			}
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			var code int
+			rec := list[j]
+			rsp := httptest.NewRecorder()
+			code, err = hnd.ServeHTTP(rsp, httptest.NewRequest("GET", rec[0], nil))
+			if err == nil {
+				str := rsp.Body.String()
+				want := strings.Replace(rec[1], "{root}", rootStr, -1)
+				if code != 0 || !strings.Contains(str, want) || (want == "" && str != "") {
+					err = fmt.Errorf("unexpected response to %s: %d, %s", rec[0], code, str)
+				}
+			}
 		}
 		if err != nil {
 			t.Fatalf("%s", err)
@@ -281,85 +392,1969 @@ pass_all_env
 	}
 }
 
-func TestMatches(t *testing.T) {
-	var ok bool
-	var prefixStr, suffixStr string
-	// [request, pattern, expected success:1/expected error:0, prefix, suffix]
+func TestIndex(t *testing.T) {
+	var err error
+	var rootStr, binStr string
+
+	script := "#!/bin/sh\nprintf 'Content-type: text/plain\\n\\n'\n/usr/bin/env\n"
+	// [request, expected status, expected text in response or Location header]
 	list := [][]string{
-		{"/foo/bar/baz", "/foo", "1", "/foo", "/bar/baz"},
-		{"/foo/bar/baz", "/foo/*/baz", "1", "/foo/bar/baz", ""},
-		{"/foo/bar/baz", "/foo/bar", "1", "/foo/bar", "/baz"},
-		{"/foo/bar/baz", "foo/bar", "0", "", ""},
+		{"/app/", "200", "SCRIPT_NAME=/app/\n"},
+		{"/app/", "200", "PATH_INFO=\n"},
+		{"/app/", "200", "SCRIPT_FILENAME={root}/app/index.sh\n"},
+		{"/app?a=1", "301", "/app/?a=1"},
+		{"/empty/", "", ""},
+		{"/", "", ""},
+		{"/bin/tool/", "200", "SCRIPT_NAME=/bin/tool/\n"},
+		{"/bin/tool/", "200", "SCRIPT_FILENAME={bin}/tool/index.cgi\n"},
+		{"/bin/tool", "301", "/bin/tool/"},
+		{"/bin/", "200", "SCRIPT_NAME=/bin/\n"},
+		{"/bin", "301", "/bin/"},
+		{"/bin/empty/", "404", ""},
+		{"/bin/tool/extra", "404", ""},
 	}
 
-	for _, rec := range list {
-		ok, prefixStr, suffixStr = match(rec[0], []string{rec[1]})
-		if ok {
-			if rec[2] == "0" || rec[3] != prefixStr || rec[4] != suffixStr {
-				t.Fatalf("expected mismatch for \"%s\" and \"%s\"", rec[0], rec[1])
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		rootStr, err = ioutil.TempDir("", "cgi")
+		if err == nil {
+			defer os.RemoveAll(rootStr)
+			binStr, err = ioutil.TempDir("", "cgi")
+			if err == nil {
+				defer os.RemoveAll(binStr)
 			}
-		} else {
-			if rec[2] == "1" {
-				t.Fatalf("expected match for \"%s\" and \"%s\"", rec[0], rec[1])
+		}
+		for _, fileStr := range []string{"app/index.sh", "empty/index.txt"} {
+			if err == nil {
+				fileStr = filepath.Join(rootStr, fileStr)
+				err = os.MkdirAll(filepath.Dir(fileStr), 0755)
+				if err == nil {
+					err = ioutil.WriteFile(fileStr, []byte(script), 0644)
+				}
+			}
+		}
+		for _, fileStr := range []string{"index.cgi", "tool/index.cgi", "empty/readme.txt"} {
+			if err == nil {
+				fileStr = filepath.Join(binStr, fileStr)
+				err = os.MkdirAll(filepath.Dir(fileStr), 0755)
+				if err == nil {
+					err = ioutil.WriteFile(fileStr, []byte(script), 0755)
+				}
+			}
+		}
+		var hnd handlerType
+		if err == nil {
+			hnd, err = handlerGet(sprintf("cgi {\nhandler .sh /bin/sh\nindex index.py index.sh\n}\n"+
+				"cgi {\ncgi_bin /bin %s\nindex index.cgi\n}", binStr), rootStr)
+			if err == nil {
+				rootStr = hnd.root
+				binStr, err = filepath.EvalSymlinks(binStr)
+			}
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			var code int
+			rec := list[j]
+			rsp := httptest.NewRecorder()
+			code, err = hnd.ServeHTTP(rsp, httptest.NewRequest("GET", rec[0], nil))
+			if err == nil {
+				status := ""
+				if code != 0 {
+					status = strconv.Itoa(code)
+				} else if rsp.Body.Len() > 0 || rsp.Code != http.StatusOK {
+					status = strconv.Itoa(rsp.Code)
+				}
+				str := rsp.Body.String()
+				if rsp.Code == http.StatusMovedPermanently {
+					str = rsp.Header().Get("Location")
+				}
+				want := strings.NewReplacer("{root}", rootStr, "{bin}", binStr).Replace(rec[2])
+				if status != rec[1] || !strings.Contains(str, want) {
+					err = fmt.Errorf("unexpected response to %s: %s, %s", rec[0], status, str)
+				}
 			}
 		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
 	}
 }
 
-func TestExceptions(t *testing.T) {
-	// [request, except pattern, expected success:1/expected error:0]
+func TestUserdir(t *testing.T) {
+	var err error
+	var homeStr string
+
+	script := "#!/bin/sh\nprintf 'Content-type: text/plain\\n\\n'\n/usr/bin/env\necho UID=`id -u`\n"
+	// [request, expected status, expected text in response]
 	list := [][]string{
-		{"/foo/bar/baz.png", "/*/*/*.png", "1"},
-		{"/foo/bar/baz.png", "/foo/*/baz*", "1"},
-		{"/foo/bar/baz.png", "/foo/bar/baz.jpg", "0"},
-		{"/foo/bar/baz.png", "foo/bar", "0"},
+		{"/~alice/cgi-bin/tool/extra", "200", "SCRIPT_NAME=/~alice/cgi-bin/tool\n"},
+		{"/~alice/cgi-bin/tool/extra", "200", "PATH_INFO=/extra\n"},
+		{"/~alice/cgi-bin/tool", "200", "SCRIPT_FILENAME={home}/public_cgi/tool\n"},
+		{"/~alice/cgi-bin/tool", "200", "REMOTE_USER=\n"},
+		{"/~alice/cgi-bin/tool", "200", "UID={uid}\n"},
+		{"/~alice/cgi-bin/open", "404", ""},
+		{"/~alice/cgi-bin/missing", "404", ""},
+		{"/~root/cgi-bin/tool", "404", ""},
+		{"/~carol/cgi-bin/tool", "", ""},
+		{"/~dave/cgi-bin/tool", "", ""},
+		{"/~alice/tool", "", ""},
 	}
 
-	for _, rec := range list {
-		ok := excluded(rec[0], []string{rec[1]})
-		if ok && rec[2] == "0" {
-			t.Fatalf("unexpected exception for \"%s\" and \"%s\"", rec[0], rec[1])
-		} else if !ok && rec[2] == "1" {
-			t.Fatalf("expected exception for \"%s\" and \"%s\"", rec[0], rec[1])
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		uid := os.Getuid()
+		if uid == 0 {
+			// scripts are never run as root
+			uid = 1000
+		}
+		homeStr, err = ioutil.TempDir("", "cgi")
+		if err == nil {
+			defer os.RemoveAll(homeStr)
+			homeStr, err = filepath.EvalSymlinks(homeStr)
+		}
+		for _, fileStr := range []string{"", "public_cgi", "public_cgi/tool", "public_cgi/open"} {
+			if err == nil {
+				fileStr = filepath.Join(homeStr, fileStr)
+				if strings.HasPrefix(filepath.Base(fileStr), "public") {
+					err = os.Mkdir(fileStr, 0755)
+				} else if fileStr == homeStr {
+					err = os.Chmod(fileStr, 0755)
+				} else {
+					err = ioutil.WriteFile(fileStr, []byte(script), 0755)
+				}
+				if err == nil && os.Getuid() == 0 {
+					err = os.Chown(fileStr, uid, uid)
+				}
+			}
+		}
+		if err == nil {
+			err = os.Chmod(filepath.Join(homeStr, "public_cgi/open"), 0775)
+		}
+		defer func(fn func(string) (*user.User, error)) {
+			lookupUser = fn
+		}(lookupUser)
+		lookupUser = func(name string) (u *user.User, err error) {
+			switch name {
+			case "alice", "carol":
+				u = &user.User{Uid: strconv.Itoa(uid), Gid: strconv.Itoa(uid), Username: name, HomeDir: homeStr}
+			case "root":
+				u = &user.User{Uid: "0", Gid: "0", Username: name, HomeDir: homeStr}
+			default:
+				err = user.UnknownUserError(name)
+			}
+			return
+		}
+		var hnd handlerType
+		if err == nil {
+			hnd, err = handlerGet("cgi {\nuserdir /cgi-bin public_cgi\nuserdir_deny carol\n}", "")
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			var code int
+			rec := list[j]
+			rsp := httptest.NewRecorder()
+			code, err = hnd.ServeHTTP(rsp, httptest.NewRequest("GET", rec[0], nil))
+			if err == nil {
+				status := ""
+				if code != 0 {
+					status = strconv.Itoa(code)
+				} else if rsp.Body.Len() > 0 {
+					status = strconv.Itoa(rsp.Code)
+				}
+				str := rsp.Body.String()
+				want := strings.NewReplacer("{home}", homeStr, "{uid}", strconv.Itoa(uid)).Replace(rec[2])
+				if status != rec[1] || !strings.Contains(str, want) {
+					err = fmt.Errorf("unexpected response to %s: %s, %s", rec[0], status, str)
+				}
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
 		}
 	}
 }
 
-func TestInspect(t *testing.T) {
+func TestFallthrough(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	directive := `cgi {
+match /fall
+exec {.}/test/fallthrough
+fallthrough 404 410
+}
+cgi /nofall {.}/test/fallthrough`
+	// [request, expected body]
+	list := [][]string{
+		{"/fall", "script output\n"},
+		{"/fall?status=404", "next handler\n"},
+		{"/fall?status=410", "next handler\n"},
+		{"/fall?status=500", "script output\n"},
+		{"/fall?header", "next handler\n"},
+		{"/nofall?status=404", "script output\n"},
+		{"/nofall?header", "script output\n"},
+	}
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		hnd, err = handlerGet(directive, "./test")
+		if err == nil {
+			hnd.next = httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				w.Write([]byte("next handler\n"))
+				return 0, nil
+			})
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			var code int
+			rec := list[j]
+			rsp := httptest.NewRecorder()
+			code, err = hnd.ServeHTTP(rsp, httptest.NewRequest("GET", rec[0], nil))
+			if err == nil && (code != 0 || rsp.Body.String() != rec[1]) {
+				err = fmt.Errorf("unexpected response to %s: %d, %s", rec[0], code, rsp.Body.String())
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	// [request, expected status, expected body]
+	list := [][]string{
+		{"POST /redirect?local", "200", "GET target=1 [200] [/redirect] [local]\n"},
+		{"GET /redirect?client", "302", ""},
+		{"GET /redirect?loop", "500", ""},
+		{"GET /redirect?server", "200", "GET server [] [] []\n"},
+		{"GET /redirect?local&server", "200", "server handler /redirect target=1\n"},
+	}
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		hnd, err = handlerGet(`cgi /redirect {.}/test/redirect`, "./test")
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("server handler " + r.URL.Path + " " + r.URL.RawQuery + "\n"))
+		})}
+		for j := 0; j < len(list) && err == nil; j++ {
+			var code int
+			rec := list[j]
+			fields := strings.Fields(rec[0])
+			req := httptest.NewRequest(fields[0], fields[1], strings.NewReader("a=1"))
+			if strings.HasSuffix(fields[1], "server") {
+				req = req.WithContext(context.WithValue(req.Context(), http.ServerContextKey, srv))
+			}
+			rsp := httptest.NewRecorder()
+			code, err = hnd.ServeHTTP(rsp, req)
+			if code == 0 {
+				code = rsp.Code
+			}
+			if rec[1] == "500" && err != nil {
+				err = nil
+			}
+			if err == nil && (strconv.Itoa(code) != rec[1] || rsp.Body.String() != rec[2]) {
+				err = fmt.Errorf("unexpected response to %s: %d, %s", rec[0], code, rsp.Body.String())
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestSendfile(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var dirStr string
+
+	// [request, request header, expected status, expected body]
+	list := [][]string{
+		{"/send?file={dir}/allowed/data.txt", "", "200", "0123456789"},
+		{"/send?file={dir}/allowed/data.txt", "Range: bytes=2-4", "206", "234"},
+		{"/send?file={dir}/allowed/data.txt", "If-Modified-Since: Fri, 01 Jan 2100 00:00:00 GMT", "304", ""},
+		{"/send?file={dir}/secret/other.txt", "", "404", ""},
+		{"/send?file={dir}/allowed/link.txt", "", "404", ""},
+		{"/send?file={dir}/allowed/missing.txt", "", "404", ""},
+		{"/send?file=allowed/data.txt", "", "404", ""},
+		{"/send?accel=/protected/data.txt", "", "200", "0123456789"},
+		{"/send?accel=/protected/../secret/other.txt", "", "404", ""},
+		{"/plain?file={dir}/allowed/data.txt", "", "500", ""},
+		{"/send?deny={dir}/allowed/data.txt", "", "403", "script output\n"},
+	}
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		dirStr, err = ioutil.TempDir("", "cgi")
+		if err == nil {
+			defer os.RemoveAll(dirStr)
+			dirStr, err = filepath.EvalSymlinks(dirStr)
+		}
+		for _, fileStr := range []string{"allowed/data.txt", "secret/other.txt"} {
+			if err == nil {
+				fileStr = filepath.Join(dirStr, fileStr)
+				err = os.MkdirAll(filepath.Dir(fileStr), 0755)
+				if err == nil {
+					err = ioutil.WriteFile(fileStr, []byte("0123456789"), 0644)
+				}
+			}
+		}
+		if err == nil {
+			err = os.Symlink(filepath.Join(dirStr, "secret/other.txt"), filepath.Join(dirStr, "allowed/link.txt"))
+		}
+		if err == nil {
+			hnd, err = handlerGet(sprintf(`cgi {
+match /send
+exec {.}/test/sendfile
+sendfile %s/allowed
+accel_redirect /protected/ %s/allowed
+}
+cgi /plain {.}/test/sendfile`, dirStr, dirStr), "./test")
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			var code int
+			rec := list[j]
+			req := httptest.NewRequest("GET", strings.Replace(rec[0], "{dir}", dirStr, -1), nil)
+			if rec[1] != "" {
+				kv := strings.SplitN(rec[1], ": ", 2)
+				req.Header.Set(kv[0], kv[1])
+			}
+			rsp := httptest.NewRecorder()
+			code, err = hnd.ServeHTTP(rsp, req)
+			if err != nil && rec[2] != "200" && rec[2] != "206" {
+				// failures are reported by way of standard error
+				err = nil
+			}
+			returned := code
+			if code == 0 {
+				code = rsp.Code
+			}
+			hdr := rsp.Header()
+			switch {
+			case err != nil:
+			case strconv.Itoa(code) != rec[2] || rsp.Body.String() != rec[3]:
+				err = fmt.Errorf("unexpected response to %s: %d, %s", rec[0], code, rsp.Body.String())
+			case rec[2] == "404" && returned != http.StatusNotFound:
+				err = fmt.Errorf("expecting status 404 to be returned for %s", rec[0])
+			case code == 200 && hdr.Get("Content-Type") != "text/plain; charset=utf-8":
+				err = fmt.Errorf("unexpected content type %s", hdr.Get("Content-Type"))
+			case code == 200 && (hdr.Get("X-Sendfile") != "" || hdr.Get("X-Accel-Redirect") != "" ||
+				hdr.Get("X-Accel-Buffering") != ""):
+				err = fmt.Errorf("expecting sendfile headers to be removed")
+			case strings.Contains(rec[0], "file=") && code == 200 && hdr.Get("Content-Disposition") != "attachment":
+				err = fmt.Errorf("expecting script headers to be kept")
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestNPH(t *testing.T) {
 	var err error
 	var hnd handlerType
 	var srv *httptest.Server
-	var buf bytes.Buffer
 
-	block := `cgi {
-  match /foo/*
-  exec bar --baz --quux
-  pass_env HOME
-  env VERY_LONG_KEY_INTENDED_TO_TEST_INSPECTION_REPORT=foo
-  inspect
+	directive := `cgi /nph-script {.}/test/nph-script
+cgi {
+match /forced
+exec /bin/bash {.}/test/nph-script
+nph
 }`
+	raw := "HTTP/1.1 299 Raw\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n"
+	// [raw request, expected raw response or its prefix]
+	list := [][]string{
+		{"GET /nph-script HTTP/1.1\r\nHost: a\r\n\r\n", raw + "GET []\n"},
+		{"POST /forced HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\n\r\na=1", raw + "POST [a=1]\n"},
+		{"GET /nph-script HTTP/1.0\r\n\r\n", raw + "GET []\n"},
+		{"GET /nph-script?bad HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n", "HTTP/1.1 502 Bad Gateway\r\n"},
+	}
 
-	hnd, err = handlerGet(block, "./test")
-	if err == nil {
-		srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			_, hndErr := hnd.ServeHTTP(w, r)
-			if err == nil && hndErr != nil {
-				err = hndErr
-			}
-		}))
-		var res *http.Response
-		res, err = http.Get(srv.URL + "/foo/bar.tcl")
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		hnd, err = handlerGet(directive, "./test")
 		if err == nil {
-			_, err = buf.ReadFrom(res.Body)
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hnd.ServeHTTP(w, r)
+			}))
+			defer srv.Close()
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			var conn net.Conn
+			var buf []byte
+			conn, err = net.Dial("tcp", srv.Listener.Addr().String())
 			if err == nil {
-				str := buf.String()
-				if !strings.Contains(str, "CGI for Caddy") {
-					err = fmt.Errorf("unexpected response for \"inspect\" request")
+				_, err = conn.Write([]byte(list[j][0]))
+				if err == nil {
+					conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+					buf, err = ioutil.ReadAll(conn)
 				}
+				conn.Close()
+			}
+			if err == nil && (!strings.HasPrefix(string(buf), list[j][1]) ||
+				(list[j][1] == raw+"GET []\n" && string(buf) != list[j][1])) {
+				err = fmt.Errorf("unexpected response to %q: %q", list[j][0], buf)
 			}
-			res.Body.Close()
 		}
-		srv.Close()
+		if err == nil {
+			// Raw output cannot be sent by way of HTTP/2
+			req := httptest.NewRequest("GET", "/nph-script", nil)
+			req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+			rsp := httptest.NewRecorder()
+			_, err = hnd.ServeHTTP(rsp, req)
+			if err == nil || rsp.Code != http.StatusHTTPVersionNotSupported {
+				err = fmt.Errorf("expecting HTTP/2 request to be rejected, got %d", rsp.Code)
+			} else {
+				err = nil
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestBodySize(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	directive := `cgi {
+name body_test
+match /limit
+exec {.}/test/body
+max_body_size 10
+}
+cgi {
+match /spool
+exec {.}/test/body
+max_body_size 20
+spool_body 4
+}`
+	// [request, body, "chunked" if body length is unknown, expected status,
+	// expected response]
+	list := [][]string{
+		{"/limit", "hello", "", "200", "[5] [hello]\n"},
+		{"/limit", "hello world", "", "413", "Request body too large.\n"},
+		{"/limit", "hello", "chunked", "200", "[] [hello]\n"},
+		{"/limit", "hello world", "chunked", "413", "Request body too large.\n"},
+		{"/spool", "ab", "chunked", "200", "[2] [ab]\n"},
+		{"/spool", "abcdefgh", "chunked", "200", "[8] [abcdefgh]\n"},
+		{"/spool", "abcdefgh", "", "200", "[8] [abcdefgh]\n"},
+		{"/spool", "abcdefghijklmnopqrstuvwxyz", "chunked", "413", "Request body too large.\n"},
+	}
+
+	killKey := `cgi_kills_total{rule="body_test",reason="max_body_size"}`
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		kills := metricSample(killKey)
+		hnd, err = handlerGet(directive, "./test")
+		for j := 0; j < len(list) && err == nil; j++ {
+			rec := list[j]
+			req := httptest.NewRequest("POST", rec[0], strings.NewReader(rec[1]))
+			if rec[2] == "chunked" {
+				req.ContentLength = -1
+				req.TransferEncoding = []string{"chunked"}
+			}
+			rsp := httptest.NewRecorder()
+			_, err = hnd.ServeHTTP(rsp, req)
+			if err == nil && (strconv.Itoa(rsp.Code) != rec[3] || rsp.Body.String() != rec[4]) {
+				err = fmt.Errorf("unexpected response to %s %q: %d, %q", rec[0], rec[1], rsp.Code, rsp.Body.String())
+			}
+		}
+		if err == nil && metricSample(killKey)-kills != 1 {
+			err = fmt.Errorf("expecting script with oversized chunked body to be killed")
+		}
+		if err == nil {
+			var size int64
+			for _, str := range []string{"512", "4k", "10M", "1GB"} {
+				if err == nil {
+					size, err = parseSize(str)
+				}
+			}
+			if err == nil && size != 1<<30 {
+				err = fmt.Errorf("unexpected size %d", size)
+			}
+			for _, str := range []string{"", "0", "-1", "M", "10X", "99999999999G"} {
+				if _, sizeErr := parseSize(str); sizeErr == nil {
+					err = fmt.Errorf("expecting \"%s\" to be rejected", str)
+				}
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestResponseSize(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var srv *httptest.Server
+
+	directive := `cgi {
+match /output
+exec {.}/test/output
+max_response_size 64
+}`
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		hnd, err = handlerGet(directive, "./test")
+		// [query, expected status, expected body]
+		for _, rec := range [][]string{{"", "200", "0123456789\n"}, {"header", "502", ""}} {
+			if err == nil {
+				rsp := httptest.NewRecorder()
+				_, err = hnd.ServeHTTP(rsp, httptest.NewRequest("GET", "/output?"+rec[0], nil))
+				if rec[1] == "502" && err != nil && strings.Contains(err.Error(), "exceeds 64 bytes") {
+					err = nil
+				}
+				if err == nil && (strconv.Itoa(rsp.Code) != rec[1] || rsp.Body.String() != rec[2]) {
+					err = fmt.Errorf("unexpected response to %s: %d, %q", rec[0], rsp.Code, rsp.Body.String())
+				}
+			}
+		}
+		if err == nil {
+			var res *http.Response
+			var buf []byte
+			done := make(chan error, 1)
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, srvErr := hnd.ServeHTTP(w, r)
+				done <- srvErr
+			}))
+			res, err = http.Get(srv.URL + "/output?endless")
+			if err == nil {
+				buf, err = ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				srvErr := <-done
+				switch {
+				case err == nil:
+					err = fmt.Errorf("expecting incomplete response to be detected")
+				case len(buf) > 64:
+					err = fmt.Errorf("expecting at most 64 bytes, got %d", len(buf))
+				case srvErr == nil || !strings.Contains(srvErr.Error(), "process killed"):
+					err = fmt.Errorf("expecting error to be reported, got %v", srvErr)
+				default:
+					err = nil
+				}
+			}
+			srv.Close()
+		}
+		if err == nil {
+			// An HTTP/2 response, served by way of Caddy, simply ends. The
+			// client can tell that it is incomplete only if the script
+			// declared a Content-Length; in any case, nothing may follow the
+			// truncated body.
+			var csrv *httpserver.Server
+			csrv, err = caddyGet(directive, "./test")
+			if err == nil {
+				srv = httptest.NewUnstartedServer(csrv)
+				srv.EnableHTTP2 = true
+				srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+				srv.StartTLS()
+				for _, query := range []string{"endless", "sized"} {
+					var res *http.Response
+					var buf []byte
+					if err == nil {
+						res, err = srv.Client().Get(srv.URL + "/output?" + query)
+					}
+					if err == nil {
+						buf, err = ioutil.ReadAll(res.Body)
+						res.Body.Close()
+						switch {
+						case res.ProtoMajor != 2:
+							err = fmt.Errorf("expecting HTTP/2 response, got %s", res.Proto)
+						case query == "sized" && err != io.ErrUnexpectedEOF:
+							err = fmt.Errorf("expecting incomplete response to be detected, got %v", err)
+						case query == "endless" && err != nil:
+						case len(buf) > 64 || strings.Contains(string(buf), "Internal Server Error"):
+							err = fmt.Errorf("expecting truncated body alone, got %q", buf)
+						default:
+							err = nil
+						}
+					}
+				}
+				srv.Close()
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	directive := `cgi {
+match /decode
+exec {.}/test/decode
+max_body_size 64
+decode_request_body
+}
+cgi {
+match /plain
+exec {.}/test/decode
+}
+cgi {
+match /unlimited
+exec {.}/test/decode
+decode_request_body
+}`
+
+	// compress returns str with the specified content codings applied in order
+	compress := func(str string, codings ...string) string {
+		for _, coding := range codings {
+			var buf bytes.Buffer
+			var zw io.WriteCloser
+			switch coding {
+			case "deflate":
+				zw = zlib.NewWriter(&buf)
+			case "br":
+				zw = brotli.NewWriter(&buf)
+			default:
+				zw = gzip.NewWriter(&buf)
+			}
+			zw.Write([]byte(str))
+			zw.Close()
+			str = buf.String()
+		}
+		return str
+	}
+	long := strings.Repeat("z", 100)
+	// [request, Content-Encoding, body, expected status, expected response]
+	list := [][]string{
+		{"/decode", "", "hello", "200", "[5] [] [hello]\n"},
+		{"/decode", "gzip", compress("hello", "gzip"), "200", "[5] [] [hello]\n"},
+		{"/decode", "deflate", compress("hello", "deflate"), "200", "[5] [] [hello]\n"},
+		{"/decode", "deflate, gzip", compress("hello", "deflate", "gzip"), "200", "[5] [] [hello]\n"},
+		{"/decode", "gzip", compress(long, "gzip"), "413", "Request body too large.\n"},
+		{"/decode", "gzip", "hello", "400", ""},
+		{"/decode", "br", compress("hello", "br"), "200", "[5] [] [hello]\n"},
+		{"/decode", "gzip, br", compress("hello", "gzip", "br"), "200", "[5] [] [hello]\n"},
+		{"/decode", "zstd", "hello", "415", "Request body content encoding not supported.\n"},
+		{"/unlimited", "gzip", compress(long, "gzip"), "200", "[100] [] [" + long + "]\n"},
+		{"/unlimited", "gzip", compress(strings.Repeat("z", decodeMaxDefault+1), "gzip"), "413", "Request body too large.\n"},
+		{"/plain", "identity", "hello", "200", "[5] [identity] [hello]\n"},
+	}
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		hnd, err = handlerGet(directive, "./test")
+		for j := 0; j < len(list) && err == nil; j++ {
+			rec := list[j]
+			req := httptest.NewRequest("POST", rec[0], strings.NewReader(rec[2]))
+			if rec[1] != "" {
+				req.Header.Set("Content-Encoding", rec[1])
+			}
+			rsp := httptest.NewRecorder()
+			_, err = hnd.ServeHTTP(rsp, req)
+			if rec[3] == "400" && err != nil && strings.Contains(err.Error(), "cannot spool") {
+				err = nil
+			}
+			if err == nil && (strconv.Itoa(rsp.Code) != rec[3] || rsp.Body.String() != rec[4]) {
+				err = fmt.Errorf("unexpected response to %s (%s): %d, %q", rec[0], rec[1], rsp.Code, rsp.Body.String())
+			}
+			if err == nil && rsp.Code == http.StatusUnsupportedMediaType &&
+				rsp.Header().Get("Accept-Encoding") != "gzip, deflate, br" {
+				err = fmt.Errorf("expecting Accept-Encoding header with 415 response")
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestUploads(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var tmpStr string
+
+	directive := `cgi {
+match /env
+exec {.}/test/upload
+uploads
+max_upload_files 2
+max_upload_size 8
+}
+cgi {
+match /json
+exec {.}/test/upload
+uploads json
+}`
+
+	// form returns a multipart/form-data body with the specified fields, each
+	// given as [name, filename or "", content], and its content type
+	form := func(parts ...[3]string) (str, ctype string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for _, part := range parts {
+			var fw io.Writer
+			if part[1] == "" {
+				fw, _ = mw.CreateFormField(part[0])
+			} else {
+				fw, _ = mw.CreateFormFile(part[0], part[1])
+			}
+			fw.Write([]byte(part[2]))
+		}
+		mw.Close()
+		return buf.String(), mw.FormDataContentType()
+	}
+	title := [3]string{"title", "", "Notes & more"}
+	fileA := [3]string{"doc", "a.txt", "alpha"}
+	fileB := [3]string{"doc", "b.txt", "bravo"}
+	list := []struct {
+		req    string
+		parts  [][3]string
+		status int
+		rsp    string
+	}{
+		{"/env", [][3]string{title, fileA, fileB}, 200,
+			"[application/x-www-form-urlencoded] [20] [title=Notes+%26+more]\n" +
+				"[doc] [a.txt] [application/octet-stream] [5] [alpha]\n" +
+				"[doc] [b.txt] [application/octet-stream] [5] [bravo]\n"},
+		{"/env", [][3]string{fileA, fileB, fileA}, 413, "Too many files uploaded.\n"},
+		{"/env", [][3]string{{"doc", "c.txt", "charlie delta"}}, 413, "Request body too large.\n"},
+		{"/json", [][3]string{title, fileA}, 200, "[application/json] "},
+		{"/json", [][3]string{{"doc", "d.bin", strings.Repeat("d", uploadSizeDefault+1)}}, 413,
+			"Request body too large.\n"},
+	}
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		// Uploads are saved beneath TMPDIR; restore it however the test ends
+		oldStr, set := os.LookupEnv("TMPDIR")
+		defer func() {
+			if set {
+				os.Setenv("TMPDIR", oldStr)
+			} else {
+				os.Unsetenv("TMPDIR")
+			}
+		}()
+		tmpStr, err = ioutil.TempDir("", "cgi")
+		if err == nil {
+			defer os.RemoveAll(tmpStr)
+			os.Setenv("TMPDIR", tmpStr)
+			hnd, err = handlerGet(directive, "./test")
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			rec := list[j]
+			str, ctype := form(rec.parts...)
+			req := httptest.NewRequest("POST", rec.req, strings.NewReader(str))
+			req.Header.Set("Content-Type", ctype)
+			rsp := httptest.NewRecorder()
+			_, err = hnd.ServeHTTP(rsp, req)
+			if err == nil && (rsp.Code != rec.status || !strings.HasPrefix(rsp.Body.String(), rec.rsp)) {
+				err = fmt.Errorf("unexpected response to %s: %d, %q", rec.req, rsp.Code, rsp.Body.String())
+			}
+			if err == nil && rec.req == "/json" && rec.status == http.StatusOK {
+				var manifest uploadManifestType
+				str = strings.TrimPrefix(rsp.Body.String(), rec.rsp)
+				str = str[strings.Index(str, "] [")+3 : len(str)-2]
+				err = json.Unmarshal([]byte(str), &manifest)
+				if err == nil && (manifest.Fields.Get("title") != "Notes & more" || len(manifest.Files) != 1 ||
+					manifest.Files[0].Filename != "a.txt" || manifest.Files[0].Size != 5 ||
+					!strings.HasPrefix(manifest.Files[0].Path, tmpStr)) {
+					err = fmt.Errorf("unexpected manifest %s", str)
+				}
+			}
+			if err == nil {
+				var names []string
+				names, err = filepath.Glob(filepath.Join(tmpStr, "*"))
+				if err == nil && len(names) > 0 {
+					err = fmt.Errorf("expecting upload directory to be removed, found %v", names)
+				}
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestDecodeParams(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	directive := `cgi {
+match /params
+exec {.}/test/params
+decode_params
+param_prefix WEB_
+param_separator ,
+max_param_size 8
+}
+cgi {
+match /few
+exec {.}/test/params
+decode_params query
+max_params 1
+}
+cgi {
+match /inspect
+exec {.}/test/params
+decode_params cookie
+inspect
+}
+cgi {
+match /operator
+exec {.}/test/params
+decode_params query form
+env QUERY_mode=operator FORM_mode=operator
+max_body_size 8
+}`
+
+	// [method, request, body, expected response]
+	list := [][]string{
+		{"POST", "/params?a=1&a=2&my-name=x&long=123456789", "b=2&c=%00z",
+			"WEB_COOKIE_sid=abc\nWEB_FORM_b=2\nWEB_FORM_c=z\nWEB_QUERY_a=1,2\nWEB_QUERY_my_name=x\n[b=2&c=%00z]\n"},
+		{"GET", "/few?b=1&a=2&STRING=x", "", "QUERY_a=2\n[]\n"},
+		{"GET", "/inspect?a=1", "", "COOKIE_sid"},
+		{"POST", "/operator?mode=client", "mode=x", "FORM_mode=operator\nQUERY_mode=operator\n[mode=x]\n"},
+		{"POST", "/operator?chunked", "b=2", "FORM_b=2\nFORM_mode=operator\nQUERY_chunked=\nQUERY_mode=operator\n[b=2]\n"},
+		{"POST", "/operator?chunked", "b=123456789", "Request body too large.\n"},
+	}
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		hnd, err = handlerGet(directive, "./test")
+		for j := 0; j < len(list) && err == nil; j++ {
+			rec := list[j]
+			req := httptest.NewRequest(rec[0], rec[1], strings.NewReader(rec[2]))
+			req.Header.Set("Cookie", "sid=abc")
+			if rec[2] != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if strings.HasSuffix(rec[1], "?chunked") {
+				req.ContentLength = -1
+				req.TransferEncoding = []string{"chunked"}
+			}
+			rsp := httptest.NewRecorder()
+			_, err = hnd.ServeHTTP(rsp, req)
+			str := rsp.Body.String()
+			status := http.StatusOK
+			if strings.HasPrefix(rec[3], "Request body") {
+				status = http.StatusRequestEntityTooLarge
+			}
+			if err == nil && (rsp.Code != status || (str != rec[3] && !strings.Contains(str, "CGI for Caddy"))) {
+				err = fmt.Errorf("unexpected response to %s: %d, %q", rec[1], rsp.Code, str)
+			}
+			if err == nil && strings.Contains(str, "CGI for Caddy") &&
+				(!strings.Contains(str, rec[3]) || strings.Contains(str, "QUERY_a")) {
+				err = fmt.Errorf("expecting decoded cookie in inspection page, got %q", str)
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestPassAll(t *testing.T) {
+	var err error
+	var code int
+	var hnd handlerType
+	var srv *httptest.Server
+	request := `/full`
+	directive := `cgi {
+match /full
+exec {.}/test/fullenv
+pass_all_env
+}`
+
+	// Testing the ServeHTTP method requires OS-specific CGI scripts, because a
+	// system call is made to respond to the request.
+	if runtime.GOOS == "linux" {
+		var buf bytes.Buffer
+		hnd, err = handlerGet(directive, "./test")
+		if err == nil {
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				code, err = hnd.ServeHTTP(w, r)
+				if err != nil {
+					fmt.Fprintf(&buf, "code [%d], error [%s]\n", code, err)
+				}
+			}))
+			fmt.Fprintf(&buf, "=== Directive ===\n%s\n", directive)
+			var res *http.Response
+			fmt.Fprintf(&buf, "--- Request %s ---\n", request)
+			res, err = http.Get(srv.URL + request)
+			if err == nil {
+				_, err = buf.ReadFrom(res.Body)
+				res.Body.Close()
+			}
+			srv.Close()
+		}
+		if err == nil {
+			err = checkEnv(buf.String())
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	var ok bool
+	var prefixStr, suffixStr string
+	// [request, pattern, expected success:1/expected error:0, prefix, suffix]
+	list := [][]string{
+		{"/foo/bar/baz", "/foo", "1", "/foo", "/bar/baz"},
+		{"/foo/bar/baz", "/foo/*/baz", "1", "/foo/bar/baz", ""},
+		{"/foo/bar/baz", "/foo/bar", "1", "/foo/bar", "/baz"},
+		{"/foo/bar/baz", "foo/bar", "0", "", ""},
+		{"/tools/a/b/x.py", "/tools/**/*.py", "1", "/tools/a/b/x.py", ""},
+		{"/tools/x.py/extra/info", "/tools/**/*.py", "1", "/tools/x.py", "/extra/info"},
+		{"/tools/a/x.py/b/y.py/info", "/tools/**/*.py", "1", "/tools/a/x.py/b/y.py", "/info"},
+		{"/tools/a/b/x.sh", "/tools/**/*.py", "0", "", ""},
+		{"/tools/a/b", "/tools/**", "1", "/tools/a/b", ""},
+		{"/tools", "/tools/**", "1", "/tools", ""},
+		{"/a/b/c/d.cgi/e", "/**/**/d.cgi", "1", "/a/b/c/d.cgi", "/e"},
+		{"/tools/a/b", "/tools/**/[", "0", "", ""},
+	}
+
+	for _, rec := range list {
+		ok, prefixStr, suffixStr = match(rec[0], []string{rec[1]})
+		if ok {
+			if rec[2] == "0" || rec[3] != prefixStr || rec[4] != suffixStr {
+				t.Fatalf("expected mismatch for \"%s\" and \"%s\"", rec[0], rec[1])
+			}
+		} else {
+			if rec[2] == "1" {
+				t.Fatalf("expected match for \"%s\" and \"%s\"", rec[0], rec[1])
+			}
+		}
+	}
+}
+
+func TestMatchRegexp(t *testing.T) {
+	// [request, expression, expected success:1/expected error:0, prefix, suffix, captures]
+	list := [][]string{
+		{"/api/users/42", `^/api/(?P<svc>[a-z]+)`, "1", "/api/users", "/42", "svc=users"},
+		{"/api/users/42", `^/api/(?P<svc>[a-z]+)(?P<path_info>/.*)?$`, "1", "/api/users", "/42", "svc=users path_info=/42"},
+		{"/api/users", `^/api/(?P<svc>[a-z]+)(?P<path_info>/.*)?$`, "1", "/api/users", "", "svc=users path_info="},
+		{"/api/users/42", `^/api/(?P<svc>[a-z]+)/(?P<rest>.*)$`, "1", "/api/users", "/42", "svc=users rest=42"},
+		{"/api/users/", `^/api/(?P<svc>[a-z]+)/(?P<rest>.*)$`, "1", "/api/users", "/", "svc=users rest="},
+		{"/api/users/42/x", `^/api/([a-z]+)(/.*)$`, "1", "/api/users", "/42/x", ""},
+		{"/api/users", `^/api/(?P<svc>[a-z]+)$`, "1", "/api", "/users", "svc=users"},
+		{"/file12", `^/file(?P<n>[0-9]+)$`, "1", "/file12", "", "n=12"},
+		{"/api/users", `^(/api/users)$`, "1", "/api/users", "", ""},
+		{"/x/report.cgi/a", `\.cgi`, "1", "/x/report.cgi", "/a", ""},
+		{"/api/Users", `^/api/(?P<svc>[a-z]+)$`, "0", "", "", ""},
+	}
+
+	for _, rec := range list {
+		ok, prefixStr, suffixStr, caps := matchRegexp(rec[0], []*regexp.Regexp{regexp.MustCompile(rec[1])})
+		var capList []string
+		for _, kv := range caps {
+			capList = append(capList, kv[0]+"="+kv[1])
+		}
+		if ok {
+			if rec[2] == "0" || rec[3] != prefixStr || rec[4] != suffixStr || rec[5] != strings.Join(capList, " ") {
+				t.Fatalf("unexpected result [%s] [%s] %v for \"%s\" and \"%s\"", prefixStr, suffixStr, capList, rec[0], rec[1])
+			}
+		} else if rec[2] == "1" {
+			t.Fatalf("expected match for \"%s\" and \"%s\"", rec[0], rec[1])
+		}
+	}
+}
+
+func TestRegexpServe(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var code int
+
+	directive := `cgi {
+  match_regexp ^/(?P<dir>[a-z]+)/(?P<script>[a-z]+)(?P<path_info>/.*)?$
+  exec {.}/{re.dir}/{re.script}
+  dir {.}/{re.dir}
+  env SERVICE={re.script}
+}`
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		hnd, err = handlerGet(directive, "./test")
+		if err == nil {
+			req := httptest.NewRequest("GET", "/test/fullenv/a/b", nil)
+			rec := httptest.NewRecorder()
+			code, err = hnd.ServeHTTP(rec, req)
+			if err == nil {
+				str := rec.Body.String()
+				for _, want := range []string{"SCRIPT_NAME=/test/fullenv\n", "PATH_INFO=/a/b\n",
+					"RE_SCRIPT=fullenv\n", "RE_PATH_INFO=/a/b\n", "SERVICE=fullenv\n",
+					"PWD=" + currentDir() + "/test\n"} {
+					if err == nil && !strings.Contains(str, want) {
+						err = fmt.Errorf("expecting \"%s\" in %s", trim(want), str)
+					}
+				}
+				if err == nil && code != 0 {
+					err = fmt.Errorf("unexpected status %d", code)
+				}
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+// catalogDirective returns a configuration of count rules of the kind that
+// are generated from a catalog, followed by a catch-all rule
+func catalogDirective(count int) string {
+	var buf bytes.Buffer
+	for j := 0; j < count; j++ {
+		fmt.Fprintf(&buf, "cgi {\n  match /catalog/item%d/*.cgi /legacy/item%d\n  except /catalog/item%d/skip.cgi\n  exec /bin/item%d\n}\n", j, j, j, j)
+	}
+	buf.WriteString("cgi /*/*/*.cgi /bin/any\n")
+	return buf.String()
+}
+
+func TestRuleIndex(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	directive := `cgi {
+  match /b/c
+  exec /bin/bc
+}
+cgi {
+  handler .txt /bin/txt
+}
+cgi {
+  handler .Md /bin/md
+  ignore_case
+}
+` + catalogDirective(20) + `cgi {
+  match /tools/**/*.py /x*/y /
+  exec /bin/tools
+}
+cgi {
+  match_regexp ^/api/(?P<svc>[a-z]+)
+  exec /bin/api
+}
+cgi {
+  match /reports/2020
+  methods POST
+  exec /bin/report-post
+}
+cgi {
+  match /reports
+  exec /bin/report
+}
+cgi {
+  match reports
+  exec /bin/relative
+}`
+	list := []string{"/a/../b/c/..", "/a/../b/c/../", "/b/c/./d/..", "/b/./c", "/b/x/../c/y",
+		"/a/b/../../b/c/.", "/reports/../b/c/../../reports", "/catalog/item3/a.cgi", "/catalog/item3/skip.cgi", "/catalog/item19/b.cgi/extra",
+		"/catalog/item20/a.cgi", "/legacy/item7/more", "/legacy//item7", "/legacy/x/../item8/y",
+		"/tools/a/b/c.py", "/xyz/y/z", "/api/users/1", "/reports/2020/q1", "/reports",
+		"/catalog/./item4/a.cgi", "/other", "", "/", "//", "/a/b/c.cgi",
+		"/example.txt/a.md", "/example.TXT", "/x/../example.txt", "/a.MD/b", "/a.ſh"}
+
+	hnd, err = handlerGet(directive, "./test")
+	for j := 0; j < len(list) && err == nil; j++ {
+		for _, method := range []string{"GET", "POST"} {
+			req := httptest.NewRequest(method, "/", nil)
+			req.URL.Path = list[j]
+			linear := hnd
+			linear.index = nil
+			ok1, rule1, m1 := linear.find(req, req.URL.Path)
+			ok2, rule2, m2 := hnd.find(req, req.URL.Path)
+			if err == nil && (ok1 != ok2 || rule1.exe != rule2.exe || m1.prefix != m2.prefix || m1.suffix != m2.suffix) {
+				err = fmt.Errorf("index disagrees for %s %s: [%v %s %s] versus [%v %s %s]",
+					method, list[j], ok1, rule1.exe, m1.prefix, ok2, rule2.exe, m2.prefix)
+			}
+		}
+	}
+	if err == nil && len(hnd.index.candidates("/catalog/item3/a.cgi", len(hnd.rules))) > 5 {
+		err = fmt.Errorf("expecting index to narrow the candidate rules")
+	}
+	if err == nil && fmt.Sprint(hnd.index.candidates("/x/A.md/y.txt", len(hnd.rules))[:2]) != "[1 2]" {
+		err = fmt.Errorf("expecting handler rules to be indexed by extension")
+	}
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	var err error
+
+	rules := `cgi /report /bin/report
+cgi {
+  match /report/weekly/*.lua
+  exec /bin/weekly
+}
+cgi {
+  match /report/*/*.lua
+  priority 5
+  exec /bin/lua
+}
+cgi {
+  match /report/daily.lua
+  exec /bin/daily
+}`
+	// [order, request, expected executable]
+	list := [][]string{
+		{"config", "/report/weekly/a.lua", "/bin/lua"},
+		{"config", "/report/monthly/a.lua", "/bin/lua"},
+		{"config", "/report/daily.lua", "/bin/report"},
+		{"config", "/report/weekly/x", "/bin/report"},
+		{"specificity", "/report/weekly/a.lua", "/bin/lua"},
+		{"specificity", "/report/daily.lua", "/bin/daily"},
+		{"specificity", "/report/weekly/x", "/bin/report"},
+	}
+	for j := 0; j < len(list) && err == nil; j++ {
+		var hnd handlerType
+		rec := list[j]
+		hnd, err = handlerGet("cgi order "+rec[0]+"\n"+rules, "./test")
+		if err == nil {
+			ok, rule, _ := hnd.find(httptest.NewRequest("GET", rec[1], nil), rec[1])
+			if !ok || rule.exe != rec[2] {
+				err = fmt.Errorf("expecting %s to be handled by %s in %s order, got %s", rec[1], rec[2], rec[0], rule.exe)
+			}
+		}
+	}
+	if err == nil && (specificity("/report/*/*.lua") != 13 || specificity(`/a\*[bc]?`) != 3) {
+		err = fmt.Errorf("unexpected specificity")
+	}
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestShadowWarnings(t *testing.T) {
+	rule := func(matches ...string) ruleType {
+		return ruleType{matches: matches}
+	}
+	// [earlier rule, later rule, expected shadowed:1/not shadowed:0]
+	list := []struct {
+		earlier, later ruleType
+		shadowed       bool
+	}{
+		{rule("/report"), rule("/report/x"), true},
+		{rule("/report"), rule("/report/*.lua", "/report"), true},
+		{rule("/report/*"), rule("/report/x/y"), true},
+		{rule("/"), rule("/anything/*"), true},
+		{rule("/tools/**"), rule("/tools/a/b.py"), true},
+		{rule("/report/x"), rule("/report"), false},
+		{rule("/report"), rule("/report/x", "/other"), false},
+		{rule("/report/*.lua"), rule("/report/x"), false},
+		{ruleType{matches: []string{"/report"}, methods: []string{"GET"}}, rule("/report/x"), false},
+		{ruleType{matches: []string{"/report"}, exceptions: []string{"/report/x"}}, rule("/report/x"), false},
+	}
+	for j, rec := range list {
+		if shadowed(rec.earlier, rec.later) != rec.shadowed {
+			t.Fatalf("unexpected shadow result for case %d", j)
+		}
+	}
+	rules := []ruleType{rule("/report"), rule("/report/x"), {matches: []string{"/report/y"}, priority: -1}}
+	if len(shadowWarnings(rules, false)) != 2 || len(shadowWarnings(rules, true)) != 1 {
+		t.Fatalf("unexpected shadow warnings %v", shadowWarnings(rules, false))
+	}
+}
+
+// benchmarkFind measures rule selection among a large number of rules, with
+// or without the rule index
+func benchmarkFind(b *testing.B, indexed bool) {
+	hnd, err := handlerGet(catalogDirective(500), "./test")
+	if err != nil {
+		b.Fatalf("%s", err)
+	}
+	if !indexed {
+		hnd.index = nil
+	}
+	list := []*http.Request{
+		httptest.NewRequest("GET", "/catalog/item450/run.cgi/extra/info", nil),
+		httptest.NewRequest("GET", "/legacy/item250", nil),
+		httptest.NewRequest("GET", "/misc/dir/any.cgi", nil),
+		httptest.NewRequest("GET", "/static/style.css", nil),
+	}
+	b.ResetTimer()
+	for j := 0; j < b.N; j++ {
+		hnd.find(list[j%len(list)], list[j%len(list)].URL.Path)
+	}
+}
+
+func BenchmarkFindLinear(b *testing.B) {
+	benchmarkFind(b, false)
+}
+
+func BenchmarkFindIndexed(b *testing.B) {
+	benchmarkFind(b, true)
+}
+
+func TestNormalizePath(t *testing.T) {
+	// [request target, expected path, expected error:1/no error:0]
+	list := [][]string{
+		{"/report/weekly.lua", "/report/weekly.lua", "0"},
+		{"/report//weekly.lua", "/report/weekly.lua", "0"},
+		{"/report/./weekly.lua", "/report/weekly.lua", "0"},
+		{"/report/x/../weekly.lua", "/report/weekly.lua", "0"},
+		{"/../../etc/passwd", "/etc/passwd", "0"},
+		{"/report/weekly/", "/report/weekly/", "0"},
+		{"/report/weekly//", "/report/weekly/", "0"},
+		{"/report/..", "/", "0"},
+		{"/%72eport/%7Eweekly.lua", "/report/~weekly.lua", "0"},
+		{"/my%20report.lua", "/my report.lua", "0"},
+		{"/report%2Fweekly.lua", "/report/weekly.lua", "1"},
+		{"/report%2fweekly.lua", "/report/weekly.lua", "1"},
+		{"/report/%2e%2e/secret.lua", "/secret.lua", "0"},
+		{"/Report/Weekly.LUA", "/Report/Weekly.LUA", "0"},
+	}
+	for _, rec := range list {
+		str, err := normalizePath(httptest.NewRequest("GET", rec[0], nil))
+		if str != rec[1] || (err != nil) != (rec[2] == "1") {
+			t.Fatalf("unexpected normalization of \"%s\": \"%s\", %v", rec[0], str, err)
+		}
+	}
+}
+
+func TestIgnoreCase(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	directive := `cgi {
+  match /report/*.lua
+  except /report/private*
+  ignore_case
+  exec /bin/report
+}
+cgi {
+  match_regexp ^/api/(?P<svc>[a-z]+)
+  ignore_case
+  exec /bin/api
+}
+cgi /Exact /bin/exact`
+	// [request target, expected executable, SCRIPT_NAME, PATH_INFO]
+	list := [][]string{
+		{"/Report/Weekly.LUA", "/bin/report", "/Report/Weekly.LUA", ""},
+		{"/REPORT//weekly.lua/Extra", "/bin/report", "/REPORT/weekly.lua", "/Extra"},
+		{"/report/x/../Weekly.Lua", "/bin/report", "/report/Weekly.Lua", ""},
+		{"/report/PrivateData.lua", "", "", ""},
+		{"/API/Users/1", "/bin/api", "/API/Users", "/1"},
+		{"/Exact/a", "/bin/exact", "/Exact", "/a"},
+		{"/exact/a", "", "", ""},
+	}
+	hnd, err = handlerGet(directive, "./test")
+	for j := 0; j < len(list) && err == nil; j++ {
+		rec := list[j]
+		req := httptest.NewRequest("GET", rec[0], nil)
+		reqStr, _ := normalizePath(req)
+		ok, rule, m := hnd.find(req, reqStr)
+		if ok != (rec[1] != "") || rule.exe != rec[1] || m.prefix != rec[2] || m.suffix != rec[3] {
+			err = fmt.Errorf("unexpected match of %s: %v [%s] [%s] [%s]", rec[0], ok, rule.exe, m.prefix, m.suffix)
+		}
+	}
+	if err == nil {
+		code, srvErr := hnd.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/report%2Fweekly.lua", nil))
+		if code != http.StatusBadRequest || srvErr != errEncodedSlash {
+			err = fmt.Errorf("expecting encoded slash to be rejected, got %d, %v", code, srvErr)
+		}
+	}
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestExceptions(t *testing.T) {
+	// [request, except pattern, expected success:1/expected error:0]
+	list := [][]string{
+		{"/foo/bar/baz.png", "/*/*/*.png", "1"},
+		{"/foo/bar/baz.png", "/foo/*/baz*", "1"},
+		{"/foo/bar/baz.png", "/foo/bar/baz.jpg", "0"},
+		{"/foo/bar/baz.png", "foo/bar", "0"},
+		{"/static/a/b/c.css", "/static/**", "1"},
+		{"/static", "/static/**", "1"},
+		{"/staticx/c.css", "/static/**", "0"},
+		{"/foo/bar/baz.png", "/**/*.png", "1"},
+		{"/foo/bar/baz.png", "/**/bar", "0"},
+		{"/foo/bar/baz.png", "/foo/**/**/baz.png", "1"},
+	}
+
+	for _, rec := range list {
+		ok := excluded(rec[0], []string{rec[1]})
+		if ok && rec[2] == "0" {
+			t.Fatalf("unexpected exception for \"%s\" and \"%s\"", rec[0], rec[1])
+		} else if !ok && rec[2] == "1" {
+			t.Fatalf("expected exception for \"%s\" and \"%s\"", rec[0], rec[1])
+		}
+	}
+}
+
+func TestConditions(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	directive := `cgi {
+  match /api
+  methods get POST
+  host api.example.com *.internal
+  header X-Api-Version 2 3
+  query format=json verbose
+  exec /bin/false
+  inspect
+}`
+	// [method, host, header value, query, expected match:1/expected fall through:0, host report]
+	list := [][]string{
+		{"GET", "api.example.com", "2", "format=json&verbose", "1", "api.example.com (api.example.com)"},
+		{"POST", "svc.internal:8080", "3", "verbose=&format=json", "1", "svc.internal (*.internal)"},
+		{"PUT", "api.example.com", "2", "format=json&verbose", "0"},
+		{"GET", "www.example.com", "2", "format=json&verbose", "0"},
+		{"GET", "API.Example.com", "4", "format=json&verbose", "0"},
+		{"GET", "api.example.com", "", "format=json&verbose", "0"},
+		{"GET", "api.example.com", "2", "format=xml&verbose", "0"},
+		{"GET", "api.example.com", "2", "format=json", "0"},
+	}
+
+	hnd, err = handlerGet(directive, "./test")
+	for j := 0; j < len(list) && err == nil; j++ {
+		rec := list[j]
+		req := httptest.NewRequest(rec[0], "http://"+rec[1]+"/api/v?"+rec[3], nil)
+		if rec[2] != "" {
+			req.Header.Set("X-Api-Version", rec[2])
+		}
+		rsp := httptest.NewRecorder()
+		_, err = hnd.ServeHTTP(rsp, req)
+		if err == nil {
+			str := rsp.Body.String()
+			if rec[4] == "1" {
+				for _, want := range []string{"Method ", rec[0], "Host ", rec[5], "Header ",
+					"X-Api-Version: " + rec[2], "Query ", "format=json"} {
+					if err == nil && !strings.Contains(str, want) {
+						err = fmt.Errorf("expecting \"%s\" in inspection page for request %d, got %s", want, j, str)
+					}
+				}
+			} else if str != "" {
+				err = fmt.Errorf("expecting request %d to fall through, got %s", j, str)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var srv *httptest.Server
+	var buf bytes.Buffer
+
+	block := `cgi {
+  match /foo/*
+  exec bar --baz --quux
+  pass_env HOME
+  env VERY_LONG_KEY_INTENDED_TO_TEST_INSPECTION_REPORT=foo
+  inspect
+}`
+
+	hnd, err = handlerGet(block, "./test")
+	if err == nil {
+		srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, hndErr := hnd.ServeHTTP(w, r)
+			if err == nil && hndErr != nil {
+				err = hndErr
+			}
+		}))
+		var res *http.Response
+		res, err = http.Get(srv.URL + "/foo/bar.tcl")
+		if err == nil {
+			_, err = buf.ReadFrom(res.Body)
+			if err == nil {
+				str := buf.String()
+				if !strings.Contains(str, "CGI for Caddy") {
+					err = fmt.Errorf("unexpected response for \"inspect\" request")
+				}
+			}
+			res.Body.Close()
+		}
+		srv.Close()
+	}
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var srv *httptest.Server
+
+	// [directive, request, expected substring, unexpected substring]
+	list := [][]string{
+		{`cgi {
+  match /fail
+  exec {.}/test/fail
+  debug
+}`, "/fail", "Exit status ................... exit status 3", "CGI for Caddy inspection page"},
+		{`cgi {
+  match /fail
+  exec {.}/test/fail
+  debug
+}`, "/fail", "fail error message", "CGI for Caddy inspection page"},
+		{`cgi {
+  match /noheader
+  exec {.}/test/noheader
+  debug 127.0.0.1
+}`, "/noheader", "cgi: no headers", "CGI for Caddy inspection page"},
+		{`cgi {
+  match /example
+  exec {.}/test/example
+  debug ::1 127.0.0.0/8
+}`, "/example", "CGI_LOCAL is unset", "CGI for Caddy debug page"},
+		{`cgi {
+  match /fail
+  exec {.}/test/fail
+  debug 10.0.0.0/8
+}`, "/fail", "partial output", "CGI for Caddy debug page"},
+		{`cgi {
+  match /output
+  exec {.}/test/output
+  debug
+}`, "/output?large", "Response ...................... truncated; exceeds 4194304 bytes held in memory", "CGI for Caddy inspection page"},
+		{`cgi {
+  match /output
+  exec {.}/test/output
+  debug
+}`, "/output", "0123456789", "CGI for Caddy debug page"},
+	}
+
+	// Testing the ServeHTTP method requires OS-specific CGI scripts, because a
+	// system call is made to respond to the request.
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		for j := 0; j < len(list) && err == nil; j++ {
+			rec := list[j]
+			var buf bytes.Buffer
+			hnd, err = handlerGet(rec[0], "./test")
+			if err == nil {
+				srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					hnd.ServeHTTP(w, r)
+				}))
+				var res *http.Response
+				res, err = http.Get(srv.URL + rec[1])
+				if err == nil {
+					_, err = buf.ReadFrom(res.Body)
+					res.Body.Close()
+				}
+				srv.Close()
+			}
+			if err == nil {
+				str := buf.String()
+				if !strings.Contains(str, rec[2]) {
+					err = fmt.Errorf("expecting \"%s\" in response to \"%s\", got \"%s\"", rec[2], rec[1], str)
+				} else if strings.Contains(str, rec[3]) {
+					err = fmt.Errorf("not expecting \"%s\" in response to \"%s\", got \"%s\"", rec[3], rec[1], str)
+				}
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var srv *httptest.Server
+	var rep httpserver.Replacer
+
+	directive := `cgi {
+  match /fail /killself
+  exec {.}/test{match}
+}`
+	// [request, placeholder, expected value ("*" for any non-empty value)]
+	list := [][]string{
+		{"/fail", "{cgi.rule}", "/fail /killself"},
+		{"/fail", "{cgi.exec}", currentDir() + "/test/fail"},
+		{"/fail", "{cgi.exit_code}", "3"},
+		{"/fail", "{cgi.signal}", "-"},
+		{"/fail", "{cgi.pid}", "*"},
+		{"/fail", "{cgi.duration}", "*"},
+		{"/fail", "{cgi.user_cpu}", "*"},
+		{"/fail", "{cgi.sys_cpu}", "*"},
+		{"/fail", "{cgi.max_rss}", "*"},
+		{"/killself", "{cgi.exit_code}", "-1"},
+		{"/killself", "{cgi.signal}", "killed"},
+	}
+
+	if runtime.GOOS == "linux" {
+		hnd, err = handlerGet(directive, "./test")
+		if err == nil {
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Caddy places a replacer in the request context; placeholders set
+				// by the middleware are shared with it.
+				rep = httpserver.NewReplacer(r, nil, "-")
+				r = r.WithContext(context.WithValue(r.Context(), httpserver.ReplacerCtxKey, rep))
+				hnd.ServeHTTP(w, r)
+			}))
+			for j := 0; j < len(list) && err == nil; j++ {
+				rec := list[j]
+				var res *http.Response
+				res, err = http.Get(srv.URL + rec[0])
+				if err == nil {
+					res.Body.Close()
+					str := rep.Replace(rec[1])
+					if rec[2] == "*" {
+						if str == "" || str == "-" {
+							err = fmt.Errorf("expecting value for %s after \"%s\"", rec[1], rec[0])
+						}
+					} else if str != rec[2] {
+						err = fmt.Errorf("expecting %s to be \"%s\" after \"%s\", got \"%s\"",
+							rec[1], rec[2], rec[0], str)
+					}
+				}
+			}
+			srv.Close()
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestTiming(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var srv *httptest.Server
+
+	// The second directive verifies that trailers survive the buffering
+	// performed in debug mode
+	directiveList := []string{
+		`cgi {
+  match /example
+  exec {.}/test/example
+  timing_headers all
+}`,
+		`cgi {
+  match /example
+  exec {.}/test/example
+  timing_headers all
+  debug
+}`,
+	}
+
+	// [response field, key, expected substring]
+	list := [][]string{
+		{"header", "Server-Timing", "cgi-spawn;dur="},
+		{"header", "Server-Timing", "cgi-ttfb;dur="},
+		{"header", "X-CGI-Header", "s"},
+		{"trailer", "Server-Timing", "cgi-total;dur="},
+		{"trailer", "Server-Timing", "cgi-cpu;dur="},
+		{"trailer", "X-CGI-Exit-Code", "0"},
+	}
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		for dirJ := 0; dirJ < len(directiveList) && err == nil; dirJ++ {
+			var res *http.Response
+			hnd, err = handlerGet(directiveList[dirJ], "./test")
+			if err == nil {
+				srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					hnd.ServeHTTP(w, r)
+				}))
+				res, err = http.Get(srv.URL + "/example")
+				if err == nil {
+					var buf bytes.Buffer
+					// Trailers are available only after the body has been read
+					_, err = buf.ReadFrom(res.Body)
+					res.Body.Close()
+				}
+				srv.Close()
+			}
+			for j := 0; j < len(list) && err == nil; j++ {
+				rec := list[j]
+				hdr := res.Header
+				if rec[0] == "trailer" {
+					hdr = res.Trailer
+				}
+				str := hdr.Get(rec[1])
+				if !strings.Contains(str, rec[2]) {
+					err = fmt.Errorf("directive %d: expecting %s %s to contain \"%s\", got \"%s\"",
+						dirJ, rec[0], rec[1], rec[2], str)
+				}
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var srv *httptest.Server
+	var buf bytes.Buffer
+
+	directive := `cgi metrics /cgi-metrics
+cgi {
+  name metrics_test
+  match /example /fail
+  exec {.}/test{match}
+}`
+
+	expectList := []string{
+		`# TYPE cgi_executions_total counter`,
+		`cgi_running{rule="metrics_test"} 0`,
+	}
+
+	// Samples that the two requests below increase, and by how much
+	deltaList := []struct {
+		key   string
+		delta float64
+	}{
+		{`cgi_executions_total{rule="metrics_test"}`, 2},
+		{`cgi_exits_total{rule="metrics_test",code="0"}`, 1},
+		{`cgi_exits_total{rule="metrics_test",code="3"}`, 1},
+		{`cgi_duration_seconds_bucket{rule="metrics_test",le="+Inf"}`, 2},
+		{`cgi_duration_seconds_count{rule="metrics_test"}`, 2},
+		{`cgi_ttfb_seconds_count{rule="metrics_test"}`, 2},
+	}
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		before := make([]float64, len(deltaList))
+		for j, d := range deltaList {
+			before[j] = metricSample(d.key)
+		}
+		hnd, err = handlerGet(directive, "./test")
+		if err == nil {
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hnd.ServeHTTP(w, r)
+			}))
+			for _, req := range []string{"/example", "/fail", "/cgi-metrics"} {
+				var res *http.Response
+				if err == nil {
+					res, err = http.Get(srv.URL + req)
+					if err == nil {
+						buf.Reset()
+						_, err = buf.ReadFrom(res.Body)
+						res.Body.Close()
+					}
+				}
+			}
+			srv.Close()
+		}
+		if err == nil {
+			str := buf.String()
+			for j := 0; j < len(expectList) && err == nil; j++ {
+				if !strings.Contains(str, expectList[j]+"\n") {
+					err = fmt.Errorf("expecting \"%s\" in metrics, got \"%s\"", expectList[j], str)
+				}
+			}
+			for j := 0; j < len(deltaList) && err == nil; j++ {
+				d := deltaList[j]
+				if got := metricSample(d.key) - before[j]; got != d.delta {
+					err = fmt.Errorf("expecting %s to increase by %g, got %g", d.key, d.delta, got)
+				}
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestTimeoutQueue(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var srv *httptest.Server
+
+	directive := `cgi {
+name timeout_test
+match /sleep
+exec {.}/test/sleep
+timeout 200ms
+}
+cgi {
+name queue_test
+match /queue
+exec {.}/test/sleep
+max_running 1
+}`
+
+	// scrape returns the metrics reported by srv
+	scrape := func() (str string) {
+		res, getErr := http.Get(srv.URL + "/cgi-metrics")
+		if getErr == nil {
+			buf, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			str = string(buf)
+		}
+		return
+	}
+
+	killKey := `cgi_kills_total{rule="timeout_test",reason="timeout"}`
+	execKey := `cgi_executions_total{rule="queue_test"}`
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		kills, execs := metricSample(killKey), metricSample(execKey)
+		hnd, err = handlerGet("cgi metrics /cgi-metrics\n"+directive, "./test")
+		if err == nil {
+			rsp := httptest.NewRecorder()
+			_, err = hnd.ServeHTTP(rsp, httptest.NewRequest("GET", "/sleep?exec=5", nil))
+			switch {
+			case err == nil || !strings.Contains(err.Error(), "ran longer than 200ms"):
+				err = fmt.Errorf("expecting timeout to be reported, got %v", err)
+			case rsp.Code != http.StatusGatewayTimeout:
+				err = fmt.Errorf("expecting status 504 after timeout, got %d", rsp.Code)
+			default:
+				err = nil
+			}
+		}
+		if err == nil {
+			var wg sync.WaitGroup
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hnd.ServeHTTP(w, r)
+			}))
+			for j := 0; j < 2; j++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					res, getErr := http.Get(srv.URL + "/queue?0.5")
+					if getErr == nil {
+						res.Body.Close()
+					}
+				}()
+			}
+			queued := false
+			for deadline := time.Now().Add(2 * time.Second); !queued && time.Now().Before(deadline); {
+				queued = strings.Contains(scrape(), `cgi_queued{rule="queue_test"} 1`+"\n")
+				time.Sleep(20 * time.Millisecond)
+			}
+			wg.Wait()
+			str := scrape()
+			switch {
+			case !queued:
+				err = fmt.Errorf("expecting a request to wait for a process slot")
+			case metricSample(killKey)-kills != 1:
+				err = fmt.Errorf("expecting timeout kill in metrics, got %s", str)
+			case metricSample(execKey)-execs != 2 ||
+				!strings.Contains(str, `cgi_queued{rule="queue_test"} 0`+"\n"):
+				err = fmt.Errorf("expecting queued requests to run, got %s", str)
+			}
+			srv.Close()
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+// memoryExporter retains spans in memory
+type memoryExporter struct {
+	mutex sync.Mutex
+	spans []spanType
+}
+
+func (me *memoryExporter) export(span spanType) {
+	me.mutex.Lock()
+	me.spans = append(me.spans, span)
+	me.mutex.Unlock()
+}
+
+func TestTracing(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var srv *httptest.Server
+	var exp memoryExporter
+
+	directive := `cgi tracing http://127.0.0.1:4318/v1/traces
+cgi {
+  name trace_test
+  match /traceenv /fail
+  exec {.}/test{match}
+}`
+	parentStr := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		hnd, err = handlerGet(directive, "./test")
+		if err == nil {
+			// Stop the exporter started by the configuration and record spans
+			// in memory instead
+			if otlp, ok := hnd.tracer.(*otlpExporter); ok {
+				otlp.close()
+			} else {
+				err = fmt.Errorf("expecting \"cgi tracing\" to start an OTLP exporter")
+			}
+		}
+		if err == nil {
+			hnd.tracer = &exp
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hnd.ServeHTTP(w, r)
+			}))
+			var buf bytes.Buffer
+			for _, req := range []string{"/traceenv", "/fail"} {
+				var hreq *http.Request
+				var res *http.Response
+				if err == nil {
+					hreq, err = http.NewRequest("GET", srv.URL+req, nil)
+					if err == nil {
+						hreq.Header.Set("Traceparent", parentStr)
+						hreq.Header.Set("Tracestate", "vendor=value")
+						res, err = http.DefaultClient.Do(hreq)
+						if err == nil {
+							_, err = buf.ReadFrom(res.Body)
+							res.Body.Close()
+						}
+					}
+				}
+			}
+			srv.Close()
+			if err == nil {
+				if len(exp.spans) != 2 {
+					err = fmt.Errorf("expecting 2 spans, got %d", len(exp.spans))
+				}
+			}
+			if err == nil {
+				span := exp.spans[0]
+				str := buf.String()
+				switch {
+				case !strings.Contains(str, "TRACEPARENT ["+span.traceparent()+"]"):
+					err = fmt.Errorf("expecting script to receive span context, got %s", str)
+				case !strings.Contains(str, "TRACESTATE [vendor=value]"):
+					err = fmt.Errorf("expecting script to receive trace state, got %s", str)
+				case !strings.HasPrefix(span.traceparent(), "00-0af7651916cd43dd8448eb211c80319c-"):
+					err = fmt.Errorf("expecting span to continue incoming trace, got %s", span.traceparent())
+				case strings.Contains(span.traceparent(), "b7ad6b7169203331"):
+					err = fmt.Errorf("expecting fresh span ID, got %s", span.traceparent())
+				case span.failed || !exp.spans[1].failed:
+					err = fmt.Errorf("expecting only second span to fail")
+				case exp.spans[1].statusMsg != "exit status 3":
+					err = fmt.Errorf("unexpected status message \"%s\"", exp.spans[1].statusMsg)
+				}
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestOtlpClose(t *testing.T) {
+	var err error
+	var mutex sync.Mutex
+	var bodies []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		bodies = append(bodies, string(buf))
+		mutex.Unlock()
+	}))
+	exp := otlpExporterGet(srv.URL)
+	exp.export(spanType{sampled: true, name: "cgi close_test", start: time.Now(), end: time.Now()})
+	exp.close()
+	exp.close()
+	srv.Close()
+	otlpExporters.Lock()
+	_, found := otlpExporters.mp[srv.URL]
+	otlpExporters.Unlock()
+	switch {
+	case len(bodies) != 1 || !strings.Contains(bodies[0], "cgi close_test"):
+		err = fmt.Errorf("expecting waiting span to be delivered on close, got %v", bodies)
+	case found:
+		err = fmt.Errorf("expecting closed exporter to be forgotten")
+	}
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var code int
+
+	directive := `cgi request_id
+cgi /requestid {.}/test/requestid`
+	ulidRe := regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`)
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		hnd, err = handlerGet(directive, "./test")
+		for _, id := range []string{"abc-123", "bad id", ""} {
+			if err == nil {
+				req := httptest.NewRequest("GET", "/requestid", nil)
+				if id != "" {
+					req.Header.Set("X-Request-ID", id)
+				}
+				rep := httpserver.NewReplacer(req, nil, "")
+				req = req.WithContext(context.WithValue(req.Context(), httpserver.ReplacerCtxKey, rep))
+				rec := httptest.NewRecorder()
+				code, err = hnd.ServeHTTP(rec, req)
+				got := rec.Header().Get("X-Request-ID")
+				switch {
+				case code != 0:
+					err = fmt.Errorf("unexpected status %d", code)
+				case err == nil:
+					err = fmt.Errorf("expecting standard error to be reported")
+				case id == "abc-123" && got != id:
+					err = fmt.Errorf("expecting incoming ID to be kept, got \"%s\"", got)
+				case id != "abc-123" && !ulidRe.MatchString(got):
+					err = fmt.Errorf("expecting generated ULID, got \"%s\"", got)
+				case !strings.Contains(rec.Body.String(), "REQUEST_ID ["+got+"]"):
+					err = fmt.Errorf("expecting script to receive request ID, got %s", rec.Body.String())
+				case rep.Replace("{cgi.request_id}") != got:
+					err = fmt.Errorf("unexpected placeholder value \"%s\"", rep.Replace("{cgi.request_id}"))
+				case err.Error() != "["+got+"] first line\n["+got+"] second line":
+					err = fmt.Errorf("unexpected standard error \"%s\"", err.Error())
+				default:
+					err = nil
+				}
+			}
+		}
+		if err == nil {
+			id := ulid(time.Unix(1, 0))
+			if !strings.HasPrefix(id, "00000000Z8") || ulid(time.Unix(2, 0)) <= id {
+				err = fmt.Errorf("ULID %s does not encode time in sortable form", id)
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	// [traceparent, expected valid:1/invalid:0, expected sampled:1/unsampled:0]
+	list := [][]string{
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "1", "1"},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", "1", "0"},
+		{"01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-future", "1", "1"},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra", "0", "0"},
+		{"00-00000000000000000000000000000000-b7ad6b7169203331-01", "0", "0"},
+		{"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01", "0", "0"},
+		{"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "0", "0"},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b716920333x-01", "0", "0"},
+		{"", "0", "0"},
+	}
+	for _, rec := range list {
+		_, _, sampled, ok := parseTraceparent(rec[0])
+		if ok != (rec[1] == "1") || sampled != (rec[2] == "1") {
+			t.Fatalf("unexpected result for traceparent \"%s\"", rec[0])
+		}
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	var err error
+	var body []byte
+	var exp *otlpExporter
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		buf.ReadFrom(r.Body)
+		body = buf.Bytes()
+	}))
+	req := httptest.NewRequest("GET", "/report", nil)
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	span := startSpan(req, "cgi report")
+	span.finish(req, ruleType{name: "report"}, hostType{path: "/usr/local/bin/report"}, &runType{status: 200})
+	exp = otlpExporterGet(srv.URL)
+	exp.send([]spanType{span})
+	srv.Close()
+	str := string(body)
+	for _, expect := range []string{
+		`"traceId":"0af7651916cd43dd8448eb211c80319c"`,
+		`"parentSpanId":"b7ad6b7169203331"`,
+		`"name":"cgi report"`,
+		`{"key":"cgi.rule","value":{"stringValue":"report"}}`,
+		`{"key":"http.status_code","value":{"intValue":"200"}}`,
+		`"status":{"code":2`,
+	} {
+		if err == nil && !strings.Contains(str, expect) {
+			err = fmt.Errorf("expecting %s in OTLP request, got %s", expect, str)
+		}
 	}
 	if err != nil {
 		t.Fatalf("%s", err)
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Besides its path patterns, a rule can be restricted to requests with certain
+// methods, hosts, headers and query parameters. Each kind of condition is met
+// if any of its alternatives is; a rule applies only if all of its conditions
+// are met.
+
+// hostName returns the lower case host name of the request without its port
+func hostName(r *http.Request) (str string) {
+	str = r.Host
+	if host, _, err := net.SplitHostPort(str); err == nil {
+		str = host
+	}
+	return strings.ToLower(strings.Trim(str, "[]"))
+}
+
+// globAny returns the first of patterns that matches str, if any. patterns
+// use path/Match notation.
+func globAny(patterns []string, str string) (ok bool, pattern string) {
+	for j := 0; j < len(patterns) && !ok; j++ {
+		ok, _ = path.Match(patterns[j], str)
+		if ok {
+			pattern = patterns[j]
+		}
+	}
+	return
+}
+
+// valuesMatch returns the first of vals that matches any of patterns. If
+// patterns is empty, the first value matches.
+func valuesMatch(patterns, vals []string) (ok bool, val string) {
+	for j := 0; j < len(vals) && !ok; j++ {
+		ok = len(patterns) == 0
+		if !ok {
+			ok, _ = globAny(patterns, vals[j])
+		}
+		if ok {
+			val = vals[j]
+		}
+	}
+	return
+}
+
+// conditionsMatch returns true if the request meets the method, host, header
+// and query conditions of rule, false otherwise. If true is returned, it is
+// followed by a description of each condition that was met.
+func conditionsMatch(r *http.Request, rule ruleType) (ok bool, conds []kvType) {
+	ok = true
+	if len(rule.methods) > 0 {
+		ok = false
+		for j := 0; j < len(rule.methods) && !ok; j++ {
+			ok = rule.methods[j] == r.Method
+		}
+		if ok {
+			conds = append(conds, kvType{"Method", r.Method})
+		}
+	}
+	if ok && len(rule.hosts) > 0 {
+		var pattern string
+		ok, pattern = globAny(rule.hosts, hostName(r))
+		if ok {
+			conds = append(conds, kvType{"Host", hostName(r) + " (" + pattern + ")"})
+		}
+	}
+	for j := 0; j < len(rule.headers) && ok; j++ {
+		var val string
+		ok, val = valuesMatch(rule.headers[j][1:], r.Header[rule.headers[j][0]])
+		if ok {
+			conds = append(conds, kvType{"Header", rule.headers[j][0] + ": " + val})
+		}
+	}
+	if ok && len(rule.queries) > 0 {
+		query := r.URL.Query()
+		for j := 0; j < len(rule.queries) && ok; j++ {
+			var val string
+			ok, val = valuesMatch(rule.queries[j][1:], query[rule.queries[j][0]])
+			if ok {
+				conds = append(conds, kvType{"Query", rule.queries[j][0] + "=" + val})
+			}
+		}
+	}
+	return
+}
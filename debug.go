@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// debugCaptureMax is the number of leading bytes of standard output that are
+// shown on the debug page
+const debugCaptureMax = 16 * 1024
+
+// debugResponseMax is the size of the response that is held in memory for a
+// client permitted to view the debug page, unless the rule sets
+// max_response_size
+const debugResponseMax = 4 << 20
+
+// errDebugFull is reported when a response held for the debug page exceeds
+// its limit
+var errDebugFull = errors.New("response too large to hold for debugging")
+
+// debugDefaultNets lists the client networks permitted to view the debug page
+// when no addresses follow the "debug" subdirective
+var debugDefaultNets = []string{"127.0.0.0/8", "::1/128"}
+
+// bufferWriter is an http.ResponseWriter that holds a response in memory
+// until it is known whether it should be delivered. As with the net/http
+// server, changes made to the header after WriteHeader is called only affect
+// declared trailers. A body longer than max is cut short and reported with
+// errDebugFull.
+type bufferWriter struct {
+	hdr    http.Header
+	sent   http.Header // snapshot of hdr when WriteHeader was called
+	status int
+	body   bytes.Buffer
+	max    int64
+	full   bool // true if the body has been cut short
+}
+
+func (bw *bufferWriter) Header() http.Header {
+	if bw.hdr == nil {
+		bw.hdr = make(http.Header)
+	}
+	return bw.hdr
+}
+
+func (bw *bufferWriter) WriteHeader(status int) {
+	if bw.status == 0 {
+		bw.status = status
+		bw.sent = make(http.Header)
+		for k, vv := range bw.Header() {
+			bw.sent[k] = append([]string(nil), vv...)
+		}
+	}
+}
+
+func (bw *bufferWriter) Write(p []byte) (n int, err error) {
+	bw.WriteHeader(http.StatusOK)
+	if room := bw.max - int64(bw.body.Len()); int64(len(p)) > room {
+		p = p[:room]
+		bw.full = true
+		err = errDebugFull
+	}
+	n, _ = bw.body.Write(p)
+	return
+}
+
+// flush copies the buffered response to w
+func (bw *bufferWriter) flush(w http.ResponseWriter) {
+	if bw.status != 0 {
+		for k, vv := range bw.sent {
+			w.Header()[k] = vv
+		}
+		w.WriteHeader(bw.status)
+		bw.body.WriteTo(w)
+		hdr := w.Header()
+		for _, str := range bw.sent["Trailer"] {
+			for _, k := range strings.Split(str, ",") {
+				k = http.CanonicalHeaderKey(trim(k))
+				if vv, ok := bw.hdr[k]; ok {
+					hdr[k] = vv
+				}
+			}
+		}
+	}
+}
+
+// parseNet converts an IP address or CIDR network string to a network
+func parseNet(str string) (ipNet *net.IPNet, err error) {
+	_, ipNet, err = net.ParseCIDR(str)
+	if err != nil {
+		ip := net.ParseIP(str)
+		if ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			err = nil
+		} else {
+			err = errorf("expecting IP address or CIDR network, got \"%s\"", str)
+		}
+	}
+	return
+}
+
+// debugAllowed returns true if the client at remoteAddr (host:port) belongs
+// to one of the specified networks
+func debugAllowed(nets []*net.IPNet, remoteAddr string) (ok bool) {
+	hostStr, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		hostStr = remoteAddr
+	}
+	ip := net.ParseIP(hostStr)
+	if ip != nil {
+		for j := 0; j < len(nets) && !ok; j++ {
+			ok = nets[j].Contains(ip)
+		}
+	}
+	return
+}
+
+// debugServe runs the CGI executable with its response held in memory, up to
+// the response size limit of the rule or debugResponseMax. If the execution
+// succeeds, the response is delivered normally. Otherwise, or if the response
+// is too large to hold, a page describing the failure is sent in its place.
+func debugServe(hst hostType, w http.ResponseWriter, r *http.Request) (run runType) {
+	var errBuf bytes.Buffer
+
+	bw := bufferWriter{max: hst.maxResp}
+	if bw.max <= 0 {
+		bw.max = debugResponseMax
+	}
+
+	if hst.stderr != nil {
+		hst.stderr = &syncWriter{w: io.MultiWriter(hst.stderr, &errBuf)}
+	} else {
+		hst.stderr = &syncWriter{w: &errBuf}
+	}
+	hst.capture = debugCaptureMax
+	run = hst.serve(&bw, r)
+	if run.failed() || bw.full {
+		debugPage(hst, &run, &bw, errBuf.Bytes(), w, r)
+	} else if !run.discarded() {
+		bw.flush(w)
+	}
+	return
+}
+
+// debugPage writes a plain text report of a failed CGI execution, whose
+// response was held in bw, to w
+func debugPage(hst hostType, run *runType, bw *bufferWriter, stderr []byte, w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	printf := func(format string, args ...interface{}) {
+		fmt.Fprintf(&buf, format, args...)
+	}
+
+	section := func(hdrStr string, content []byte) {
+		printf("\n%s\n%s\n", hdrStr, strings.Repeat("-", len(hdrStr)))
+		buf.Write(content)
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			printf("\n")
+		}
+	}
+
+	exitStr := "not started"
+	if run.state != nil {
+		exitStr = run.state.String()
+	}
+	errStr := ""
+	if run.err != nil {
+		errStr = run.err.Error()
+	}
+
+	printf("CGI for Caddy debug page\n\n")
+	kvPrint(&buf, "", "Request", r.Method+" "+r.URL.RequestURI())
+	kvPrint(&buf, "", "Executable", hst.path)
+	for j, arg := range hst.args {
+		kvPrint(&buf, "  ", sprintf("Arg %d", j+1), arg)
+	}
+	kvPrint(&buf, "", "Command line", trim(hst.path+" "+join(hst.args, " ")))
+	kvPrint(&buf, "", "Dir", hst.dir)
+	kvPrint(&buf, "", "Exit status", exitStr)
+	kvPrint(&buf, "", "Error", errStr)
+	if !run.start.IsZero() {
+		kvPrint(&buf, "", "Started", run.start.Format("2006-01-02 15:04:05.000 MST"))
+	}
+	kvPrint(&buf, "", "Duration", run.duration.String())
+	if bw.full {
+		kvPrint(&buf, "", "Response", sprintf("truncated; exceeds %d bytes held in memory", bw.max))
+	}
+	kvListPrint(&buf, kvSplit(hst.environment(r)), "Environment")
+	section("Standard error", stderr)
+	section(sprintf("Standard output (first %d bytes)", debugCaptureMax), run.stdout.Bytes())
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusInternalServerError)
+	buf.WriteTo(w)
+}
@@ -1,23 +1,115 @@
 package cgi
 
 import (
+	"net"
+	"regexp"
+	"time"
+
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
 )
 
 // handlerType is a middleware type that can handle CGI requests
 type handlerType struct {
-	next  httpserver.Handler
-	rules []ruleType
-	root  string // same as root, but absolute path
+	next            httpserver.Handler
+	rules           []ruleType
+	index           *ruleIndexType // candidate rules by literal path prefix
+	root            string         // same as root, but absolute path
+	metricsPath     string         // request path at which metrics are reported, if any
+	tracer          spanExporter   // recipient of execution spans, if tracing is enabled
+	requestIDHeader string         // header that conveys request IDs, if they are assigned
+	specific        bool           // true if the most specific matching pattern wins
+}
+
+// extType maps a script file extension to the interpreter that runs it
+type extType struct {
+	ext  string   // extension, including the leading period
+	exe  string   // interpreter
+	args []string // arguments that precede the script file
 }
 
 // ruleType represents a CGI handling rule; it is parsed from the cgi directive
 // in the Caddyfile
 type ruleType struct {
+	// Name used to identify rule in placeholders and metrics
+	name string // [0..1]
+	// Rules of higher priority are tried first (default 0)
+	priority int // [0..1]
+	// True if priority has been specified
+	hasPriority bool
 	// Glob patterns to match in order to apply rule
 	matches []string // glob patterns, [1..n]
+	// Regular expressions to match in order to apply rule
+	regexps []*regexp.Regexp // [0..n]
 	// Match exceptions
 	exceptions []string
+	// True to match patterns and expressions without regard to case
+	ignoreCase bool
+	// Request methods to which rule applies; all if empty
+	methods []string // [0..n]
+	// Host name glob patterns to which rule applies; all if empty
+	hosts []string // [0..n]
+	// Header conditions ([0]: canonical name, [1..]: value patterns), all of
+	// which must be met
+	headers [][]string // [0..n]
+	// Query conditions ([0]: key, [1]: optional value pattern), all of which
+	// must be met
+	queries [][]string // [0..n]
+	// Request path prefix beneath which the next path element names a script
+	binPrefix string // [0..1]
+	// Directory of scripts named by the element that follows binPrefix
+	binDir string // [0..1]
+	// Interpreters of scripts beneath the site root, by file extension
+	exts []extType // [0..n]
+	// Request path prefix, following "/~user", beneath which the next path
+	// element names a script in the user's script directory
+	userPrefix string // [0..1]
+	// Script directory relative to each user's home directory
+	userDir string // [0..1]
+	// User name glob patterns whose scripts may be run; all if empty
+	userAllow []string // [0..n]
+	// User name glob patterns whose scripts may not be run
+	userDeny []string // [0..n]
+	// Names of scripts to run for requests that name a directory
+	indexes []string // [0..n]
+	// True to hand the request to the next handler when the script asks to
+	// by way of the X-CGI-Fallthrough header or one of fallStatuses
+	fallThrough bool // [0..1]
+	// Response statuses for which the request is handed to the next handler
+	fallStatuses []int // [0..n]
+	// Directories beneath which files named by X-Sendfile may be sent
+	sendDirs []string // [0..n]
+	// X-Accel-Redirect path prefixes ([0]) and the directories ([1]) they
+	// map to
+	accels [][2]string // [0..n]
+	// True if the script writes its own status line and headers; assumed for
+	// scripts whose names begin with "nph-"
+	nph bool // [0..1]
+	// Maximum size of request bodies in bytes, or 0 for no limit
+	maxBody int64 // [0..1]
+	// True to read request bodies completely before the script starts
+	spool bool // [0..1]
+	// Size above which spooled bodies are kept in a temporary file
+	spoolMem int64 // [0..1]
+	// True to decode request bodies sent with a gzip or deflate content
+	// coding before passing them to the script
+	decodeBody bool // [0..1]
+	// Manner, "env" or "json", in which files uploaded in multipart/form-data
+	// bodies are presented to the script, or empty to pass such bodies as is
+	uploads string // [0..1]
+	// Maximum number of files per upload, or 0 for the default
+	uploadFiles int // [0..1]
+	// Maximum size in bytes of each uploaded file, or 0 for no limit
+	uploadMax int64 // [0..1]
+	// Maximum size in bytes of a script's standard output, or 0 for no limit
+	maxResponse int64 // [0..1]
+	// Time after which a running script is killed, or 0 for no limit
+	timeout time.Duration // [0..1]
+	// Maximum number of processes of this rule that may run at once, or 0 for
+	// no limit
+	maxRunning int // [0..1]
+	// Semaphore that holds one element for each running process of this rule
+	// if maxRunning is set; shared by copies of the rule
+	slots chan struct{}
 	// Name of executable script or binary
 	exe string // [1]
 	// Working directory (default, current Caddy working directory)
@@ -30,8 +122,27 @@ type ruleType struct {
 	passEnvs []string // [0..n]
 	// Environment keys to send with empty values
 	emptyEnvs []string // [0..n]
+	// Request parts ("query", "form", "cookie"), in that order, whose
+	// parameters are decoded into environment variables
+	params []string // [0..1]
+	// Prefix of the names of decoded parameter variables
+	paramPrefix string // [0..1]
+	// Separator of the values of a repeated parameter, or empty for newline
+	paramSep string // [0..1]
+	// Maximum number of decoded parameter variables, or 0 for the default
+	maxParams int // [0..1]
+	// Maximum size in bytes of a decoded parameter value, or 0 for the default
+	maxParamSize int64 // [0..1]
 	// True to return inspection page rather than call CGI executable
 	inspect bool
 	// True to pass all environment variables to CGI executable
 	passAll bool
+	// True to replace the response of a failed execution with a debug page
+	debug bool
+	// Client networks permitted to view the debug page
+	debugNets []*net.IPNet
+	// True to report execution timing in Server-Timing response headers
+	timing bool
+	// True to report execution timing in X-CGI-* response headers as well
+	timingAll bool
 }
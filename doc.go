@@ -170,6 +170,17 @@ directly from Caddy, so the Lua script does not need the shebang that
 would be needed in a standalone script. This method facilitates the use
 of CGI on the Windows platform.
 
+A path element that consists solely of two asterisks matches zero or
+more whole path elements, so a pattern can match scripts at any depth of
+a tree. Elsewhere, two asterisks behave like one. For example,
+/tools//*.py matches /tools/x.py as well as /tools/a/b/x.py, and
+/static/ matches /static and everything beneath it. As with other
+patterns, the request is matched by the longest prefix that ends at a
+slash or at the end of the request, so the request /tools/a/x.py/info
+runs /tools/a/x.py with PATH_INFO set to /info. If the remainder of the
+request itself matches, the longest match wins: /tools/a.py/b.py runs
+/tools/a.py/b.py rather than /tools/a.py.
+
 Advanced Syntax
 
 In order to specify custom environment variables, pass along one or more
@@ -178,15 +189,49 @@ pattern for a given rule, you will need to use the advanced directive
 syntax. That looks like this:
 
     cgi {
+        name name
+        priority number
         match match [match2...]
+        match_regexp expression [expression2...]
+        cgi_bin prefix directory
+        handler .ext interpreter [args...]
+        userdir prefix directory
+        userdir_allow pattern [pattern2...]
+        userdir_deny pattern [pattern2...]
+        index name [name2...]
         except match [match2...]
+        ignore_case
+        methods method [method2...]
+        host pattern [pattern2...]
+        header name [pattern...]
+        query key[=pattern] [key2[=pattern2]...]
         exec script [args...]
+        fallthrough [status...]
+        sendfile directory [directory2...]
+        accel_redirect prefix directory
+        nph
+        max_body_size size
+        max_response_size size
+        timeout duration
+        max_running count
+        spool_body [size]
+        decode_request_body
+        uploads [env|json]
+        max_upload_files count
+        max_upload_size size
         dir directory
         env key1=val1 [key2=val2...]
         pass_env key1 [key2...]
         empty_env key1 [key2...]
+        decode_params [query] [form] [cookie]
+        param_prefix prefix
+        param_separator separator
+        max_params count
+        max_param_size size
         pass_all_env
         inspect
+        debug [address...]
+        timing_headers [all]
     }
 
 For example,
@@ -200,13 +245,22 @@ For example,
         empty_env CGI_LOCAL
     }
 
-With the advanced syntax, the exec subdirective must appear exactly
-once. The match subdirective must appear at least once. The env,
-pass_env, empty_env, and except subdirectives can appear any reasonable
-number of times. pass_all_env, dir may appear once.
+With the advanced syntax, the exec subdirective must appear exactly once
+and the match and match_regexp subdirectives must appear at least once
+between them, unless the block contains a cgi_bin, userdir or handler
+subdirective instead. The env, pass_env, empty_env, except, methods,
+host, header, query, handler, index, userdir_allow, userdir_deny,
+sendfile and accel_redirect subdirectives can appear any reasonable
+number of times. pass_all_env, dir, debug, name, priority, cgi_bin,
+userdir, fallthrough, nph, max_body_size, max_response_size, timeout,
+max_running, decode_request_body, uploads, max_upload_files,
+max_upload_size, decode_params, param_prefix, param_separator,
+max_params, max_param_size and spool_body may appear once.
 
 The dir subdirective specifies the CGI executable’s working directory.
-If it is not specified, Caddy’s current working directory is used.
+If it is not specified, Caddy’s current working directory is used. Like
+the script name and arguments, the directory is subject to placeholder
+substitution.
 
 The except subdirective uses the same pattern matching logic that is
 used with the match subdirective except that the request must match a
@@ -217,6 +271,72 @@ request is rejected and passed along to subsequent handlers. This is a
 convenient way to have static file resources served properly rather than
 being confused as CGI applications.
 
+The match_regexp subdirective matches the request path against one or
+more regular expressions in Go syntax. Glob patterns given with match
+are tried first. Unlike a glob pattern, an expression is not anchored,
+so use ^ and $ to match the whole path. The request path is split into
+SCRIPT_NAME and PATH_INFO as follows. If the expression has a group
+named path_info, the script name ends where that group begins, or where
+the match ends if the group does not take part in the match. Otherwise,
+if the match extends to the end of the path, the first capture group
+that extends there becomes PATH_INFO, along with the slash just before
+it if the group does not begin with one; this applies only if PATH_INFO
+then begins with a slash and SCRIPT_NAME is not empty. In all other
+cases, the path up to the end of the match becomes SCRIPT_NAME and the
+remainder becomes PATH_INFO. Each named capture group is available as
+the placeholder {re.name} in exec, its arguments, dir and env, and is
+passed to the CGI application in the environment variable RE_NAME, where
+NAME is the group name in upper case. For example, the following rule
+dispatches /api/users/42 to /srv/users/handler with SCRIPT_NAME set to
+/api/users and PATH_INFO set to /42, as would
+^/api/(?P<svc>[a-z]+)/(?P<rest>.*)$:
+
+    cgi {
+        match_regexp ^/api/(?P<svc>[a-z]+)(?P<path_info>/.*)?$
+        exec /srv/{re.svc}/handler
+    }
+
+The methods, host, header and query subdirectives restrict a rule to
+certain requests. A request that matches a rule’s path patterns but
+fails one of these conditions is passed along to subsequent rules and
+handlers, just as if its path had not matched. methods lists the request
+methods to which the rule applies. host lists glob patterns, such as
+*.internal, that are compared without regard to case with the request’s
+host name, excluding any port. header names a request header followed by
+glob patterns for its value; if no patterns are given, the header need
+only be present. query lists query parameters in the form key or
+key=pattern; a parameter without a pattern need only be present. The
+request must use one of the listed methods, match one of the host
+patterns, and satisfy every header and query condition. For example, the
+following rule handles only JSON requests for version 2 of an API:
+
+    cgi {
+        match /api/*
+        methods GET POST
+        host api.example.com *.internal
+        header X-Api-Version 2
+        query format=json
+        exec /usr/local/bin/api
+    }
+
+The inspect page lists the conditions that the request met.
+
+Before any rule is consulted, the request path is normalized.
+Percent-encoded characters are decoded, . and .. elements are resolved,
+duplicate slashes are collapsed, and a trailing slash is kept. Patterns,
+expressions and exceptions are matched against the normalized path, and
+SCRIPT_NAME, PATH_INFO and the {match} placeholder are taken from it.
+For example, the request /report//x/../weekly.lua/extra is matched as
+/report/weekly.lua/extra. A request whose path contains an encoded slash
+(%2F) would be ambiguous, so if it matches a rule, it is rejected with
+status 400 rather than run. The original request is still available to
+the CGI application in REQUEST_URI.
+
+The ignore_case subdirective makes the rule’s match, match_regexp and
+except patterns match without regard to the case of ASCII letters, so
+that match /report/*.lua also matches /Report/Weekly.LUA. SCRIPT_NAME
+and PATH_INFO keep the case of the request.
+
 The empty_env subdirective is used to pass one or more empty environment
 variables. Some CGI scripts may expect the server to pass certain empty
 variables rather than leaving them unset. This subdirective allows you
@@ -242,6 +362,561 @@ is that a lot of server information is shared with the CGI executable.
 Use this subdirective only with CGI applications that you trust not to
 leak this information.
 
+Script Directories
+
+Rather than writing a rule for each script, you can have a rule run any
+executable in a directory, in the manner of Apache’s ScriptAlias. The
+following line runs the scripts in /srv/cgi-bin:
+
+    cgi cgi_bin /cgi-bin /srv/cgi-bin
+
+The path element that follows the prefix names the script. For example,
+the request /cgi-bin/report/weekly runs /srv/cgi-bin/report with
+SCRIPT_NAME set to /cgi-bin/report, PATH_INFO set to /weekly and
+SCRIPT_FILENAME set to /srv/cgi-bin/report. If the script does not exist
+or is not a regular executable file, the request fails with status 404.
+So does a request for the prefix itself, such as /cgi-bin/, when no
+index script applies, and one whose script element contains a backslash.
+A relative directory is taken relative to Caddy’s current working
+directory.
+
+The cgi_bin subdirective does the same in the advanced syntax, where it
+takes the place of match and exec and can be combined with subdirectives
+such as env, pass_env, except and methods:
+
+    cgi {
+        cgi_bin /cgi-bin /srv/cgi-bin
+        env DB=/srv/data/app.db
+        pass_env HOME
+    }
+
+Extension Handlers
+
+To run scripts that are kept among the other files of a site, map their
+extension to an interpreter, in the manner of Apache’s AddHandler:
+
+    cgi handler .py /usr/bin/python3
+    cgi handler .pl /usr/bin/perl -T
+
+Any request that resolves to an existing file beneath the site root with
+a mapped extension is run through the interpreter, with any arguments
+given in the mapping followed by the path of the file. The request path
+is resolved one element at a time, so the request /app/report.py/weekly
+runs /usr/bin/python3 ROOT/app/report.py with SCRIPT_NAME set to
+/app/report.py and PATH_INFO set to /weekly. SCRIPT_FILENAME names the
+script rather than the interpreter. Requests for files that do not
+exist, files with other extensions and files that lie outside the site
+root, including by way of a symbolic link, are passed along to
+subsequent handlers. This replaces rules that use {root}{match} in exec.
+
+In the advanced syntax, the handler subdirective can appear any number
+of times and takes the place of match and exec:
+
+    cgi {
+        handler .py /usr/bin/python3
+        handler .pl /usr/bin/perl -T
+        except /vendor/*
+        pass_env HOME
+    }
+
+User Directories
+
+On a shared server, each user can keep scripts in a directory of their
+own home. The following line runs /home/alice/public_cgi/tool for the
+request /~alice/cgi-bin/tool:
+
+    cgi userdir /cgi-bin public_cgi
+
+The path that follows /~alice is handled as it is beneath a cgi_bin
+prefix, with SCRIPT_NAME set to /~alice/cgi-bin/tool and PATH_INFO to
+the remainder of the path. The script runs as its owner, in the script’s
+directory, in the manner of Apache’s suEXEC. This requires Caddy to run
+as root unless every script belongs to the user that Caddy runs as, and
+is not supported on Windows. REMOTE_USER still reports the authenticated
+user, if any.
+
+Before a script is run, the script and every directory between it and
+the user’s home directory, inclusive, must belong to the user and must
+not be writable by group or others; apart from the home directory
+itself, none of them may be a symbolic link. Scripts are never run as
+root. A request for a script that does not exist or fails these checks
+returns status 404, and failed checks are logged. In the advanced
+syntax, userdir_allow and userdir_deny take user name patterns in
+path/Match notation. When userdir_allow is present, only users who match
+one of its patterns are served; users who match a userdir_deny pattern
+never are. Requests for other users are passed along to subsequent
+handlers:
+
+    cgi {
+        userdir /cgi-bin public_cgi
+        userdir_allow dev-*
+        userdir_deny dev-guest
+    }
+
+Directory Indexes
+
+With cgi_bin, userdir or handler, the index subdirective names scripts
+to run for a request that resolves to a directory. The first name that
+exists in the directory is used, and with handler it must have a mapped
+extension:
+
+    cgi {
+        handler .py /usr/bin/python3
+        index index.cgi index.py
+    }
+
+Here /app/ runs ROOT/app/index.py with SCRIPT_NAME set to /app/ and
+PATH_INFO empty. As with Caddy’s static file server, a request for /app
+without the trailing slash is redirected to /app/ with status 301,
+keeping the query string. A directory with no index script is passed
+along to subsequent handlers in the case of handler, and returns status
+404 beneath a cgi_bin prefix.
+
+Fallthrough
+
+A script can decline a request and let the handlers that follow cgi in
+the site’s chain, such as the static file server, respond instead. The
+fallthrough subdirective enables this for a rule, optionally followed by
+response statuses that have the same effect:
+
+    cgi {
+        match /docs/*
+        exec /usr/local/bin/render
+        fallthrough 404
+    }
+
+When the script’s response carries the X-CGI-Fallthrough header with any
+value, or one of the listed statuses, its headers and body are discarded
+and the request is passed along to the next handler. Later cgi rules
+that also match the request are not tried; to run another script,
+respond with a local redirect instead. The script’s output is read to
+the end so that it exits normally. Any request body that the script has
+already read is not available to the next handler, so this is best
+suited to GET and HEAD requests.
+
+Local Redirects
+
+A script can respond with nothing but a Location header that holds a
+path, such as Location: /reports/latest?format=csv. As described in RFC
+3875, this local redirect is not sent to the client. Instead, a GET
+request for the path and query string is served in place of the original
+one, through the full chain of handlers of the site, so that rewrites,
+other cgi rules and static files all apply. The headers of the original
+request are kept, apart from those that describe its body. A script that
+runs for the redirected request receives REDIRECT_STATUS, REDIRECT_URL
+and REDIRECT_QUERY_STRING, which describe the request that was
+redirected. A chain of more than 10 local redirects fails with status
+500. A Location header that holds a full URL, or that is accompanied by
+a Status header, is sent to the client as usual.
+
+Sending Files
+
+A script that streams a large file to the client occupies a process for
+the whole transfer. Instead, once it has checked that the request is
+permitted, a script can name the file in an X-Sendfile header, in the
+manner of Apache’s mod_xsendfile, or give an internal path in an
+X-Accel-Redirect header, in the manner of nginx. The file is then served
+by the plugin after the script exits, with support for range requests,
+conditional requests and content type detection. Any other output of the
+script is discarded.
+
+These headers are honored only for rules that permit them. The sendfile
+subdirective lists the directories beneath which files named by
+X-Sendfile must lie. Each accel_redirect subdirective maps a path prefix
+to a directory, so that with the following rule, X-Accel-Redirect:
+/protected/2020/q1.pdf sends /srv/protected/2020/q1.pdf:
+
+    cgi {
+        match /download/*
+        exec /usr/local/bin/download
+        sendfile /srv/files /srv/archive
+        accel_redirect /protected /srv/protected
+    }
+
+Symbolic links are resolved before a file is checked against its
+directories. A file that does not exist or lies elsewhere is not sent,
+and the request fails with status 404, which Caddy’s error pages can
+handle. The headers are ignored when the script’s Status header holds
+anything other than a 2xx code, so that a script can refuse a request
+with, for example, Status: 403 whatever else it sends. Other headers of
+the script’s response, such as Content-Disposition and Cache-Control,
+are passed along to the client. The script may leave out Content-Type,
+in which case it is determined from the file.
+
+NPH Scripts
+
+A non-parsed header (NPH) script writes the complete HTTP response
+itself, starting with a status line such as HTTP/1.1 200 OK. Scripts
+whose names begin with nph- are treated this way, as is any script run
+by a rule that contains the nph subdirective. Once the status line has
+been checked, the script’s output is copied to the client connection
+without change, so the script is responsible for the headers and for
+framing the body, typically by sending Connection: close. A script whose
+output does not begin with a valid status line fails with status 502.
+Raw output is only possible with HTTP/1.x, so NPH requests that arrive
+by way of HTTP/2 fail with status 505. Because the connection is taken
+over, a request body is copied to a temporary file before the script
+starts.
+
+Request Bodies
+
+By default, a request body is passed to the script’s standard input as
+it arrives, with no limit on its size. The max_body_size subdirective
+sets a limit, in bytes or with a K, M or G suffix for multiples of 1024.
+A request whose declared Content-Length exceeds the limit fails with
+status 413 before the script starts.
+
+Bodies sent with chunked transfer encoding have no declared length, so
+such a body is passed along as it arrives without CONTENT_LENGTH and the
+script reads it until its input ends. The size limit is enforced as the
+script reads the body: if the body turns out to be too large, the script
+is killed before its input ends, so that it never takes a truncated body
+for a complete one. The request fails with status 413 if the script has
+not yet begun its response; otherwise the response is cut short as
+described under Response Size. The spool_body subdirective has the
+plugin read each body completely before the script starts, so that
+CONTENT_LENGTH is always set, an oversized body always fails with status
+413, and a slow client does not hold a script process. Bodies up to the
+size that follows spool_body, 1M by default, are held in memory and
+larger ones in a temporary file that is removed after the script exits.
+
+    cgi {
+        match /upload
+        exec /usr/local/bin/upload
+        max_body_size 10M
+        spool_body 256K
+    }
+
+The decode_request_body subdirective has the plugin undo the gzip,
+deflate or br content coding of a request body, as named by its
+Content-Encoding header, so that the script reads the original data.
+Such a body is spooled as described above, CONTENT_LENGTH reports its
+decoded length, and HTTP_CONTENT_ENCODING is not set. The size limit
+applies to the decoded body, so a small compressed body that expands
+beyond it fails with status 413. If max_body_size is not given, a
+decoded body is limited to 16 MiB. A body that cannot be decoded fails
+with status 400, and one with any other content coding fails with status
+415.
+
+Uploads
+
+The uploads subdirective has the plugin receive multipart/form-data
+request bodies, such as those of HTML forms with file inputs, in place
+of the script. Each uploaded file is saved in a temporary directory that
+is created for the request and removed after the script exits. The
+script learns of the files and of the ordinary form fields in one of two
+ways, named by the argument that follows uploads.
+
+With env, the default, the ordinary fields are passed to the script’s
+standard input as a URL-encoded body with CONTENT_TYPE set to
+application/x-www-form-urlencoded, just as if the form had been sent
+without files. UPLOAD_COUNT holds the number of files, and each file,
+numbered from 0, is described by variables such as UPLOAD_0_FIELD (the
+name of the form field), UPLOAD_0_FILENAME (the file name given by the
+client), UPLOAD_0_CONTENT_TYPE, UPLOAD_0_SIZE and UPLOAD_0_PATH (the
+location of the saved file).
+
+With json, a manifest is passed to the script’s standard input with
+CONTENT_TYPE set to application/json. Its fields member maps each field
+name to a list of values, and its files member is a list of objects with
+field, filename, content_type, path and size members.
+
+A request may upload 10 files unless the max_upload_files subdirective
+specifies another number, and each file may hold 32M unless the
+max_upload_size subdirective specifies another size. Together, these
+bound the disk space a request can use even without max_body_size. A
+request that exceeds either limit, or the max_body_size limit of the
+whole body, fails with status 413, as does one whose ordinary fields
+together exceed 1M. Files are saved under names chosen by the plugin;
+the file name given by the client is never used to locate a file. For
+userdir rules, the directory and files are given to the user whose
+script runs.
+
+    cgi {
+        match /upload
+        exec /usr/local/bin/upload
+        uploads json
+        max_upload_files 4
+        max_upload_size 20M
+    }
+
+Response Size
+
+The max_response_size subdirective limits what a script may write to its
+standard output, headers included, using the same notation for sizes as
+max_body_size. When the limit is exceeded, the script is killed and the
+incident is reported as an error. If the response header has not yet
+been sent, the request fails with status 502. Otherwise, the response is
+cut short. With HTTP/1.x, the connection is closed so that the client
+can tell that the response is incomplete. With HTTP/2, the response
+simply ends, and the client can tell only if the script sent a
+Content-Length header. The cgi_kills_total metric counts such kills with
+the reason max_response_size.
+
+Decoded Parameters
+
+The decode_params subdirective has the plugin decode the parameters of a
+request and pass each one to the script in an environment variable,
+sparing shell scripts the work of parsing them. Parameters of the query
+string are passed in variables named QUERY_name, fields of a URL-encoded
+form body in FORM_name, and cookies in COOKIE_name. The subdirective may
+be followed by query, form or cookie to decode only those parts of the
+request; by default, all three are decoded. The param_prefix
+subdirective specifies a prefix for the variable names, so that with
+param_prefix WEB_ the query parameter id is passed in WEB_QUERY_id.
+
+Any character of a parameter name other than an ASCII letter, digit or
+underscore is replaced with an underscore, so that user-name becomes
+QUERY_user_name. The values of a parameter that appears more than once
+are joined with a newline, or with the string that follows the
+param_separator subdirective. A query parameter named STRING is left out
+so that it does not replace QUERY_STRING.
+
+The form body is decoded only if its Content-Type is
+application/x-www-form-urlencoded, it is not compressed or is decoded by
+decode_request_body, and it is no larger than 1M. Such a body is spooled
+as described under request bodies, so that its size limit is checked
+before it is decoded, and is then passed intact to the script’s standard
+input. When uploads are received in the env manner, their ordinary
+fields are decoded as well. At most 64 variables are set unless the
+max_params subdirective specifies another number, and a variable whose
+value is longer than 4K, or the size that follows the max_param_size
+subdirective, is left out. A variable set by the rule with env or
+empty_env takes precedence over a decoded parameter of the same name.
+The query and cookie variables are listed along with the rest of the
+script’s environment on the inspection page.
+
+    cgi {
+        match /search
+        exec /usr/local/cgi-bin/search.sh
+        decode_params query cookie
+        param_prefix WEB_
+        param_separator ,
+        max_params 20
+        max_param_size 1K
+    }
+
+Timeouts and Concurrency
+
+The timeout subdirective limits how long a script may run, with a
+duration such as 30s or 2m. A script that runs longer is killed and the
+incident is reported as an error; if it has not yet sent its response
+header, the request fails with status 504. Only the script’s own process
+is killed, so a script that starts long-running child processes of its
+own should see to them itself.
+
+The max_running subdirective limits the number of processes of the rule
+that may run at once. Requests that arrive while the limit is reached
+wait for a running process to finish, and are served in turn. A request
+whose client goes away while it waits is dropped with status 503.
+
+    cgi {
+        match /report
+        exec /usr/local/cgi-bin/report
+        timeout 30s
+        max_running 4
+    }
+
+Rule Order
+
+Rules are tried in the order in which they appear in the Caddyfile, and
+the first rule that matches a request handles it. When rules come from
+several imported snippets, this order can be hard to control. The
+priority subdirective takes an integer, which may be negative, and moves
+a rule ahead of all rules of lower priority; rules without it have
+priority 0. Rules of equal priority keep their Caddyfile order.
+
+Alternatively, add the following line to your Caddyfile to have the most
+specific pattern win:
+
+    cgi order specificity
+
+In this mode, a request that matches several rules of the same priority
+is handled by the rule whose matching pattern is most specific, that is,
+has the most characters other than wildcards and character classes. For
+a regular expression, the length of its literal prefix is used. Ties go
+to the rule that appears first. The default mode can be stated
+explicitly with cgi order config.
+
+When Caddy starts, it logs a warning for each rule that can never handle
+a request because an earlier rule handles every request that the rule
+matches. For example, a rule that matches /report/x placed after one
+that matches /report is reported. Only rules without except, methods,
+host, header and query subdirectives are considered to shadow others,
+and rules that use match_regexp are not checked.
+
+Timing Headers
+
+The timing_headers subdirective adds a Server-Timing header to the
+responses of your CGI application so that the time spent in each phase
+of its execution can be examined with the developer tools of your
+browser. The header reports three durations, each measured from the
+moment Caddy begins to launch the process: cgi-spawn, the time taken to
+start the process; cgi-ttfb, the time until the first byte of output
+arrives; and cgi-header, the time until the response header has been
+read. The total duration (cgi-total) and the CPU time consumed by the
+process (cgi-cpu) are only known after the process exits, so they are
+sent in a Server-Timing trailer at the end of the response body.
+Trailers are not sent with responses for which the application itself
+specifies a Content-Length.
+
+If the subdirective is followed by all, the same information is also
+sent in X-CGI-Spawn, X-CGI-TTFB and X-CGI-Header headers and in
+X-CGI-Duration, X-CGI-User-CPU, X-CGI-Sys-CPU, X-CGI-Exit-Code and
+X-CGI-Max-RSS trailers.
+
+    cgi {
+        match /report
+        exec /usr/local/cgi-bin/report
+        timing_headers all
+    }
+
+These headers reveal details about your server and are intended for
+performance work rather than routine production use.
+
+Metrics
+
+The plugin keeps statistics about the CGI applications it runs and can
+report them in the Prometheus text format. To make them available, add a
+line of the following form to your Caddyfile, where the path is the
+request path at which the metrics are served:
+
+    cgi metrics /cgi-metrics
+
+The statistics are kept for each rule and are labelled with the rule’s
+name. Only rules given a short, stable name with the name subdirective
+are reported; unnamed rules are left out so that no path ever appears in
+a label and no label is shared by unrelated rules. Rules with the same
+name, in the same site or in different sites, share their statistics.
+The following metrics are reported:
+
+-   cgi_executions_total counts completed executions
+
+-   cgi_running is the number of processes currently running
+
+-   cgi_queued is the number of requests waiting for a process because
+the rule’s max_running limit has been reached
+
+-   cgi_exits_total counts executions by exit code in the code label; -1
+means the process was terminated by a signal and none means that it
+could not be started
+
+-   cgi_kills_total counts processes that were killed by the server, by
+reason in the reason label: timeout for a script that ran longer than
+its rule’s timeout, max_response_size for one whose output was too
+large, max_body_size for one whose chunked request body was too large,
+and copy_error for one whose response could not be delivered
+
+-   cgi_request_bytes_total counts request body bytes passed to
+processes
+
+-   cgi_response_bytes_total counts response body bytes sent to clients
+
+-   cgi_duration_seconds is a histogram of the time from process launch
+to exit
+
+-   cgi_ttfb_seconds is a histogram of the time from process launch to
+the first byte of output
+
+For example,
+
+    cgi metrics /cgi-metrics
+    cgi {
+        name report
+        match /report
+        exec /usr/local/cgi-bin/report
+    }
+
+The statistics cover every site served by the Caddy process. You will
+likely want to restrict access to the metrics path, for example with
+HTTP Basic Authentication or the ipfilter directive.
+
+Tracing
+
+Each execution of a CGI application can be recorded as a span in an
+OpenTelemetry trace. To enable tracing, add a line of the following form
+to your Caddyfile, where the URL identifies the traces endpoint of an
+OTLP/HTTP collector:
+
+    cgi tracing http://localhost:4318/v1/traces
+
+If the incoming request carries a W3C traceparent header, the span
+continues that trace; otherwise a new trace is started. The span is
+named after the rule (see the name subdirective) and its attributes
+include the request method and target, the response status, the rule,
+the executable, its process ID and exit code, and the launch, first byte
+and total durations. Executions that fail are marked with an error
+status. Spans are sent to the collector in batches, in the OTLP JSON
+encoding, at most a couple of seconds after they complete. If the
+collector cannot keep up, spans are dropped rather than delaying
+responses.
+
+The context of the span is passed to your CGI application in the
+TRACEPARENT environment variable. Its span ID is freshly generated for
+the execution, so a script that records spans of its own can use this
+value to make them children of the execution span. The incoming
+tracestate header, if any, is passed in TRACESTATE. As with all request
+headers, the original values are also available as HTTP_TRACEPARENT and
+HTTP_TRACESTATE.
+
+Request IDs
+
+To correlate the log entries of a request with those of the CGI
+application that handles it, the plugin can assign each request an ID.
+To enable this, add a line of the following form to your Caddyfile:
+
+    cgi request_id [header]
+
+The optional header argument names the request and response header that
+carries the ID; it defaults to X-Request-ID. If the incoming request
+carries this header with a value of up to 128 letters, digits, dashes,
+underscores, periods and colons, that value is used. Otherwise, the ID
+assigned by the Caddy request_id directive is used if there is one;
+failing that, a new ULID is generated.
+
+The ID is passed to your CGI application in the REQUEST_ID environment
+variable, returned to the client in the response header, made available
+to the log directive as the {cgi.request_id} placeholder, and recorded
+as a span attribute when tracing is enabled. Each line that the
+application writes to its standard error stream is prefixed with the ID
+in square brackets before it is reported to the Caddy error log.
+
+Execution Placeholders
+
+After each CGI application completes, the plugin sets a number of
+placeholders that describe the execution. These can be used by
+middleware that runs after the response is written, most usefully the
+Caddy log directive. The following placeholders are available:
+
+-   {cgi.rule} is the name of the rule that handled the request or, if
+it has none, its match patterns
+
+-   {cgi.exec} is the path of the executable that was run
+
+-   {cgi.pid} is the process ID of the executable
+
+-   {cgi.exit_code} is the exit code of the executable, or -1 if it was
+terminated by a signal
+
+-   {cgi.signal} is the name of the signal that terminated the
+executable
+
+-   {cgi.duration} is the time from launch to exit
+
+-   {cgi.user_cpu} is the user CPU time consumed by the executable
+
+-   {cgi.sys_cpu} is the system CPU time consumed by the executable
+
+-   {cgi.max_rss} is the maximum resident set size, in bytes, of the
+executable
+
+Values that do not apply, such as the signal of an executable that
+exited normally, are left unset and are reported by the log with its
+usual empty value. The signal and resident set size are not available on
+all platforms. For example,
+
+    log / /var/log/caddy/access.log "{remote} {uri} {status} {cgi.exit_code} {cgi.duration} {cgi.max_rss}"
+
 JSON web tokens
 
 If you protect your CGI application with the Caddy JWT middleware, your
@@ -322,6 +997,38 @@ application is called.
 To return to operation mode, remove or comment out the inspect
 subdirective.
 
+Debugging
+
+Inspection mode shows what would be run, but not what went wrong when it
+ran. For that, add the debug subdirective to your CGI configuration
+block. When a client whose address is permitted makes a matching
+request, the plugin holds the response of the CGI application in memory.
+If the application exits with a non-zero status, is terminated by a
+signal, cannot be started, or returns malformed headers, the response is
+replaced with a text page that shows the command line, the working
+directory, the exit status, the start time and duration of the
+execution, the complete environment, everything the application wrote to
+its standard error stream, and the first 16 KB of its standard output.
+Successful responses are delivered unchanged. At most 4 MiB of a
+response is held, or the rule’s max_response_size if it is set. If the
+response is longer, the application is killed and the debug page is sent
+in its place.
+
+The debug subdirective can be followed by one or more IP addresses or
+CIDR networks. Only clients with a matching address are shown the debug
+page; other clients receive the application’s response as usual. If no
+addresses are given, only loopback clients (127.0.0.0/8 and ::1) are
+permitted.
+
+    cgi {
+        match /report
+        exec /usr/local/cgi-bin/report
+        debug 127.0.0.1 192.168.1.0/24
+    }
+
+Like inspection mode, this is a development option. The debug page
+exposes server details that should not be shared with the public.
+
 Environment Variable Example
 
 In this example, the Caddyfile looks like this:
@@ -2,4 +2,7 @@ module github.com/jung-kurt/caddy-cgi
 
 go 1.12
 
-require github.com/caddyserver/caddy v1.0.1
+require (
+	github.com/andybalholm/brotli v1.0.0
+	github.com/caddyserver/caddy v1.0.1
+)
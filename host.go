@@ -0,0 +1,614 @@
+/*
+ * Copyright (c) 2017-2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// The host side of the CGI exchange in this file is adapted from the
+// net/http/cgi package of the Go standard library (copyright 2011 The Go
+// Authors, BSD-style license). It is reproduced here so that the details of
+// each execution, which cgi.Handler keeps to itself, are available to the
+// middleware.
+
+package cgi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var trailingPort = regexp.MustCompile(`:([0-9]+)$`)
+
+// osDefaultInheritEnv lists the environment variables that are passed to
+// every CGI process on the current platform
+var osDefaultInheritEnv = map[string][]string{
+	"darwin":  {"DYLD_LIBRARY_PATH"},
+	"freebsd": {"LD_LIBRARY_PATH"},
+	"hpux":    {"LD_LIBRARY_PATH", "SHLIB_PATH"},
+	"irix":    {"LD_LIBRARY_PATH", "LD_LIBRARYN32_PATH", "LD_LIBRARY64_PATH"},
+	"linux":   {"LD_LIBRARY_PATH"},
+	"openbsd": {"LD_LIBRARY_PATH"},
+	"solaris": {"LD_LIBRARY_PATH", "LD_LIBRARY_PATH_32", "LD_LIBRARY_PATH_64"},
+	"windows": {"SystemRoot", "COMSPEC", "PATHEXT", "WINDIR"},
+}
+
+// hostType runs an executable in a subprocess with a CGI environment
+type hostType struct {
+	path       string               // path to the CGI executable
+	root       string               // root URI prefix of handler or empty for "/"
+	dir        string               // working directory of CGI executable
+	env        []string             // extra environment variables, as "key=value"
+	inheritEnv []string             // environment variables to inherit from host, as "key"
+	args       []string             // optional arguments to pass to child process
+	stderr     io.Writer            // stderr for the child process and host diagnostics
+	capture    int                  // number of leading stdout bytes to retain in runType
+	timing     bool                 // true to report execution timing in response headers
+	timingAll  bool                 // true to include X-CGI-* headers with timing report
+	attr       *syscall.SysProcAttr // process attributes, such as user credentials
+	fall       bool                 // true to honor fallthrough header and statuses
+	fallOn     []int                // response statuses that cause fallthrough
+	sendDirs   []string             // directories of files that X-Sendfile may name
+	accels     [][2]string          // X-Accel-Redirect path prefixes and directories
+	nph        bool                 // true if executable writes raw HTTP response
+	maxBody    int64                // maximum size of request body, or 0 for no limit
+	spool      bool                 // true to read request body before launch
+	spoolMem   int64                // size above which spooled body goes to a file
+	decode     bool                 // true to undo content coding of request body
+	uploads    string               // manner of presenting uploaded files, or empty
+	maxUpload  int64                // maximum size of each uploaded file, or 0 for no limit
+	maxFiles   int                  // maximum number of uploaded files, or 0 for default
+	maxResp    int64                // maximum size of standard output, or 0 for no limit
+	timeout    time.Duration        // time after which process is killed, or 0 for no limit
+	params     paramsType           // request parameters to decode into the environment
+}
+
+// runType reports the outcome of a single CGI execution
+type runType struct {
+	start    time.Time        // time at which process was launched
+	duration time.Duration    // time from launch to process exit
+	spawn    time.Duration    // time taken to launch process
+	ttfb     time.Duration    // time from launch to first byte of output
+	header   time.Duration    // time from launch to end of response header
+	bytesIn  int64            // request body bytes passed to process
+	bytesOut int64            // response body bytes sent to client
+	kill     string           // reason process was killed, if it was
+	state    *os.ProcessState // nil if process could not be started
+	status   int              // HTTP status code sent to client
+	fell     bool             // true if response was discarded for next handler
+	unsent   bool             // true if file requested by script could not be sent
+	location string           // path of local redirect response, if any
+	err      error            // launch or response header error
+	stdout   bytes.Buffer     // leading portion of raw standard output
+}
+
+// timeoutType kills a CGI process that runs longer than its rule permits
+type timeoutType struct {
+	timer *time.Timer
+	fired int32 // set atomically when the process is killed
+}
+
+// watch arranges for the process of cmd to be killed if it is still running
+// when the rule's timeout elapses. The returned value is nil if the rule has
+// no timeout.
+func (hst hostType) watch(cmd *exec.Cmd) (to *timeoutType) {
+	if hst.timeout > 0 {
+		to = &timeoutType{}
+		to.timer = time.AfterFunc(hst.timeout, func() {
+			atomic.StoreInt32(&to.fired, 1)
+			cmd.Process.Kill()
+		})
+	}
+	return
+}
+
+// expired returns true if the process has been killed for running too long
+func (to *timeoutType) expired() bool {
+	return to != nil && atomic.LoadInt32(&to.fired) != 0
+}
+
+// stop cancels the timeout and reports whether the process was killed for
+// running too long
+func (to *timeoutType) stop() (fired bool) {
+	if to != nil {
+		to.timer.Stop()
+	}
+	return to.expired()
+}
+
+// failed returns true if the CGI process could not be started, exited
+// unsuccessfully, or produced an unusable response
+func (run *runType) failed() bool {
+	return run.err != nil || run.state == nil || !run.state.Success()
+}
+
+// discarded returns true if the script's response was withheld from the client
+// so that the request could be served in another way
+func (run *runType) discarded() bool {
+	return run.fell || run.location != "" || run.unsent
+}
+
+// abortResponse ends a response that has been cut short in a way that the
+// client can detect. With HTTP/1.x, the connection is closed before the body
+// is complete. Otherwise, the response simply ends; an HTTP/2 stream cannot be
+// reset from within Caddy, which recovers from handler panics, so the client
+// can only tell if the script declared a Content-Length.
+func abortResponse(w http.ResponseWriter) {
+	if hj, ok := w.(http.Hijacker); ok {
+		conn, _, err := hj.Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}
+}
+
+// syncWriter serializes writes to w. The child's standard error stream is
+// copied to hostType.stderr concurrently with host diagnostics, and a plain
+// buffer would lose some of them.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sw *syncWriter) Write(p []byte) (n int, err error) {
+	sw.mu.Lock()
+	n, err = sw.w.Write(p)
+	sw.mu.Unlock()
+	return
+}
+
+// limitWriter retains at most max bytes of what is written to it while
+// reporting success for everything
+type limitWriter struct {
+	buf *bytes.Buffer
+	max int
+}
+
+func (lw limitWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	room := lw.max - lw.buf.Len()
+	if room > 0 {
+		if room > n {
+			room = n
+		}
+		lw.buf.Write(p[:room])
+	}
+	return
+}
+
+// firstByteReader records the time at which data first arrives from rdr
+type firstByteReader struct {
+	rdr  io.Reader
+	when *time.Time
+}
+
+func (fb firstByteReader) Read(p []byte) (n int, err error) {
+	n, err = fb.rdr.Read(p)
+	if n > 0 && fb.when.IsZero() {
+		*fb.when = time.Now()
+	}
+	return
+}
+
+// countReader counts the bytes read from rdr
+type countReader struct {
+	rdr   io.Reader
+	count *int64
+}
+
+func (cr countReader) Read(p []byte) (n int, err error) {
+	n, err = cr.rdr.Read(p)
+	*cr.count += int64(n)
+	return
+}
+
+// logf writes a host diagnostic message to the CGI error stream
+func (hst hostType) logf(format string, args ...interface{}) {
+	if hst.stderr != nil {
+		fmt.Fprintf(hst.stderr, format+"\n", args...)
+	}
+}
+
+// removeLeadingDuplicates removes leading duplicates in environments so that
+// later entries override earlier ones
+func removeLeadingDuplicates(env []string) (ret []string) {
+	for j, e := range env {
+		found := false
+		if eq := strings.IndexByte(e, '='); eq != -1 {
+			keq := e[:eq+1] // "key="
+			for _, e2 := range env[j+1:] {
+				if strings.HasPrefix(e2, keq) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			ret = append(ret, e)
+		}
+	}
+	return
+}
+
+// upperCaseAndUnderscore maps a header name rune to its environment key form
+func upperCaseAndUnderscore(r rune) rune {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return r - ('a' - 'A')
+	case r == '-', r == '=':
+		return '_'
+	}
+	return r
+}
+
+// validHeaderName returns true if str is a valid HTTP header field name
+func validHeaderName(str string) (ok bool) {
+	ok = len(str) > 0
+	for j := 0; j < len(str) && ok; j++ {
+		ch := str[j]
+		ok = ch > ' ' && ch < 0x7f && !strings.ContainsRune("\"(),/:;<=>?@[\\]{}", rune(ch))
+	}
+	return
+}
+
+// environment returns the full environment of the CGI process for the
+// specified request
+func (hst hostType) environment(req *http.Request) (env []string) {
+	root := strings.TrimRight(hst.root, "/")
+	pathInfo := strings.TrimPrefix(req.URL.Path, root)
+
+	port := "80"
+	if req.TLS != nil {
+		port = "443"
+	}
+	if matches := trailingPort.FindStringSubmatch(req.Host); len(matches) != 0 {
+		port = matches[1]
+	}
+
+	env = []string{
+		"SERVER_SOFTWARE=go",
+		"SERVER_PROTOCOL=HTTP/1.1",
+		"HTTP_HOST=" + req.Host,
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"REQUEST_METHOD=" + req.Method,
+		"QUERY_STRING=" + req.URL.RawQuery,
+		"REQUEST_URI=" + req.URL.RequestURI(),
+		"PATH_INFO=" + pathInfo,
+		"SCRIPT_NAME=" + root,
+		"SCRIPT_FILENAME=" + hst.path,
+		"SERVER_PORT=" + port,
+	}
+
+	if remoteIP, remotePort, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		env = append(env, "REMOTE_ADDR="+remoteIP, "REMOTE_HOST="+remoteIP, "REMOTE_PORT="+remotePort)
+	} else {
+		env = append(env, "REMOTE_ADDR="+req.RemoteAddr, "REMOTE_HOST="+req.RemoteAddr)
+	}
+
+	if hostDomain, _, err := net.SplitHostPort(req.Host); err == nil {
+		env = append(env, "SERVER_NAME="+hostDomain)
+	} else {
+		env = append(env, "SERVER_NAME="+req.Host)
+	}
+
+	if req.TLS != nil {
+		env = append(env, "HTTPS=on")
+	}
+
+	for k, v := range req.Header {
+		k = strings.Map(upperCaseAndUnderscore, k)
+		if k != "PROXY" { // See Go issue 16405
+			joinStr := ", "
+			if k == "COOKIE" {
+				joinStr = "; "
+			}
+			env = append(env, "HTTP_"+k+"="+strings.Join(v, joinStr))
+		}
+	}
+
+	if req.ContentLength > 0 {
+		env = append(env, sprintf("CONTENT_LENGTH=%d", req.ContentLength))
+	}
+	if ctype := req.Header.Get("Content-Type"); ctype != "" {
+		env = append(env, "CONTENT_TYPE="+ctype)
+	}
+
+	envPath := os.Getenv("PATH")
+	if envPath == "" {
+		envPath = "/bin:/usr/bin:/usr/ucb:/usr/bsd:/usr/local/bin"
+	}
+	env = append(env, "PATH="+envPath)
+
+	for _, e := range hst.inheritEnv {
+		if v := os.Getenv(e); v != "" {
+			env = append(env, e+"="+v)
+		}
+	}
+
+	for _, e := range osDefaultInheritEnv[runtime.GOOS] {
+		if v := os.Getenv(e); v != "" {
+			env = append(env, e+"="+v)
+		}
+	}
+
+	env = append(env, hst.env...)
+	env = removeLeadingDuplicates(env)
+	return
+}
+
+// readHeader reads the CGI response header block from rdr. If the block is
+// malformed, an error is returned. local is true for a local redirect
+// response, that is, one with a Location header that holds a path and no
+// Status header.
+func (hst hostType) readHeader(rdr *bufio.Reader) (hdr http.Header, statusCode int, local bool, err error) {
+	var line []byte
+	var isPrefix bool
+	var headerLines int
+	var sawBlankLine bool
+
+	hdr = make(http.Header)
+	for err == nil && !sawBlankLine {
+		line, isPrefix, err = rdr.ReadLine()
+		if isPrefix {
+			err = errorf("cgi: long header line from subprocess")
+		} else if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			err = errorf("cgi: error reading headers: %s", err)
+		} else if len(line) == 0 {
+			sawBlankLine = true
+		} else {
+			headerLines++
+			pair := strings.SplitN(string(line), ":", 2)
+			if len(pair) != 2 {
+				hst.logf("cgi: bogus header line: %s", line)
+			} else if !validHeaderName(pair[0]) {
+				hst.logf("cgi: invalid header name: %q", pair[0])
+			} else {
+				key := pair[0]
+				val := textproto.TrimString(pair[1])
+				if key == "Status" {
+					if len(val) < 3 {
+						err = errorf("cgi: bogus status (short): %q", val)
+					} else {
+						statusCode, err = strconv.Atoi(val[0:3])
+						if err != nil {
+							err = errorf("cgi: bogus status: %q", val)
+						}
+					}
+				} else {
+					hdr.Add(key, val)
+				}
+			}
+		}
+	}
+	if err == nil {
+		if headerLines == 0 || !sawBlankLine {
+			err = errorf("cgi: no headers")
+		} else if loc := hdr.Get("Location"); loc != "" {
+			if statusCode == 0 {
+				statusCode = http.StatusFound
+				local = strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//")
+			}
+		} else if statusCode == 0 && hdr.Get("Content-Type") == "" && !hst.sendRequested(hdr) {
+			err = errorf("cgi: missing required Content-Type in headers")
+		}
+		if statusCode == 0 {
+			statusCode = http.StatusOK
+		}
+	}
+	return
+}
+
+// fallthroughHeader is the response header with which a script asks that its
+// response be discarded and the request handed to the next handler
+const fallthroughHeader = "X-CGI-Fallthrough"
+
+// fallsThrough returns true if the script response with header hdr and status
+// code is to be discarded in favor of the next handler
+func (hst hostType) fallsThrough(hdr http.Header, code int) (ok bool) {
+	if hst.fall {
+		ok = hdr.Get(fallthroughHeader) != ""
+		for j := 0; j < len(hst.fallOn) && !ok; j++ {
+			ok = hst.fallOn[j] == code
+		}
+	}
+	return
+}
+
+// start launches the CGI executable for req, with the reader of body, if not
+// nil, as its standard input. The returned reader is connected to its
+// standard output. The launch is recorded in run; run.err is set if it fails.
+func (hst hostType) start(req *http.Request, body bodyType, run *runType) (cmd *exec.Cmd, stdout io.ReadCloser) {
+	var cwd, pathStr string
+
+	if hst.dir != "" {
+		pathStr = hst.path
+		cwd = hst.dir
+	} else {
+		cwd, pathStr = filepath.Split(hst.path)
+	}
+	if cwd == "" {
+		cwd = "."
+	}
+
+	// Variables derived from the request body, such as decoded parameters,
+	// precede those of the rule so that a client cannot replace the latter
+	hst.env = append(body.env[:len(body.env):len(body.env)], hst.env...)
+	cmd = &exec.Cmd{
+		Path:        pathStr,
+		Args:        append([]string{hst.path}, hst.args...),
+		Dir:         cwd,
+		Env:         hst.environment(req),
+		Stdin:       body.rdr,
+		Stderr:      hst.stderr,
+		SysProcAttr: hst.attr,
+	}
+	stdout, run.err = cmd.StdoutPipe()
+	if run.err == nil {
+		run.start = time.Now()
+		run.err = cmd.Start()
+		run.spawn = time.Since(run.start)
+		if run.err == nil && body.stream != nil {
+			body.stream.proc <- cmd.Process
+		}
+	}
+	return
+}
+
+// timedOut stops to and, if the process was killed for running too long,
+// records and reports it
+func (hst hostType) timedOut(to *timeoutType, run *runType) {
+	if to.stop() {
+		hst.logf("cgi: process ran longer than %s; killed", hst.timeout)
+		run.kill = "timeout"
+	}
+}
+
+// serve runs the CGI executable for the specified request and copies its
+// response to w. The details of the execution are returned.
+func (hst hostType) serve(w http.ResponseWriter, req *http.Request) (run runType) {
+	body, ok := hst.prepareBody(w, req, &run, false)
+	if !ok {
+		return
+	}
+	defer body.close()
+	req = body.request(req)
+	cmd, stdout := hst.start(req, body, &run)
+	if run.err != nil {
+		hst.logf("cgi: %s", run.err)
+		run.status = http.StatusInternalServerError
+		w.WriteHeader(run.status)
+		return
+	}
+	to := hst.watch(cmd)
+
+	var firstByte time.Time
+	lr := &limitReader{rdr: firstByteReader{rdr: stdout, when: &firstByte},
+		max: hst.maxResp, err: errResponseTooLarge}
+	var src io.Reader = lr
+	if hst.capture > 0 {
+		src = io.TeeReader(src, limitWriter{buf: &run.stdout, max: hst.capture})
+	}
+	rdr := bufio.NewReaderSize(src, 1024)
+	hdr, statusCode, local, err := hst.readHeader(rdr)
+	headerTooLarge := err != nil && lr.exceeded()
+	if headerTooLarge {
+		err = errorf("cgi: response header exceeds %d bytes", hst.maxResp)
+	} else if body.exceeded() {
+		// The script was killed before it began its response
+		err = errBodyTooLarge
+	}
+	run.header = time.Since(run.start)
+	if !firstByte.IsZero() {
+		run.ttfb = firstByte.Sub(run.start)
+	}
+	if err == nil && local {
+		run.location = hdr.Get("Location")
+	} else if err == nil {
+		run.fell = hst.fallsThrough(hdr, statusCode)
+	}
+	send := err == nil && !run.discarded() && statusCode/100 == 2 && hst.sendRequested(hdr)
+	if run.discarded() || send {
+		// Nothing has been written to w; let the script finish undisturbed
+		run.status = statusCode
+		io.Copy(ioutil.Discard, rdr)
+	} else if err == nil {
+		for k, vv := range hdr {
+			for _, v := range vv {
+				w.Header().Add(k, v)
+			}
+		}
+		if hst.timing {
+			setTimingHeaders(w.Header(), &run, hst.timingAll)
+		}
+		run.status = statusCode
+		w.WriteHeader(run.status)
+		run.bytesOut, err = io.Copy(w, rdr)
+		if lr.exceeded() || body.exceeded() {
+			// The response is incomplete; make sure the client can tell
+			run.err = err
+			abortResponse(w)
+		} else if err != nil {
+			// The client may have gone away; kill the child so that the wait below
+			// does not hang. Killing a process that has already exited is
+			// harmless.
+			hst.logf("cgi: copy error: %s", err)
+			run.kill = "copy_error"
+			cmd.Process.Kill()
+		}
+	} else if err == errBodyTooLarge {
+		// As when the body is refused before the script starts, the fault lies
+		// with the client and is not reported as an error
+		run.status = http.StatusRequestEntityTooLarge
+		w.WriteHeader(run.status)
+		w.Write([]byte("Request body too large.\n"))
+	} else {
+		run.err = err
+		hst.logf("%s", err)
+		run.status = http.StatusInternalServerError
+		if headerTooLarge {
+			run.status = http.StatusBadGateway
+		} else if to.expired() {
+			run.status = http.StatusGatewayTimeout
+		}
+		w.WriteHeader(run.status)
+		if hst.capture > 0 {
+			// Drain remaining output so that it is captured
+			io.Copy(ioutil.Discard, rdr)
+		}
+	}
+	if lr.exceeded() {
+		hst.logf("cgi: response exceeds %d bytes; process killed", hst.maxResp)
+		run.kill = "max_response_size"
+		cmd.Process.Kill()
+	}
+	stdout.Close()
+	cmd.Wait()
+	if body.exceeded() {
+		run.kill = "max_body_size"
+		if send {
+			send = false
+			run.status = http.StatusRequestEntityTooLarge
+			w.WriteHeader(run.status)
+			w.Write([]byte("Request body too large.\n"))
+		}
+	}
+	run.duration = time.Since(run.start)
+	run.state = cmd.ProcessState
+	hst.timedOut(to, &run)
+	if send {
+		hst.sendFile(w, req, hdr, &run)
+	}
+	if hst.timing && run.err == nil && !run.discarded() {
+		setTimingTrailers(w.Header(), &run, hst.timingAll)
+	}
+	return
+}
@@ -20,7 +20,6 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
-	"net/http/cgi"
 	"os"
 	"sort"
 	"strings"
@@ -32,44 +31,58 @@ type kvType struct {
 	key, val string
 }
 
-func inspect(hnd cgi.Handler, w http.ResponseWriter, req *http.Request, rep httpserver.Replacer) {
-	var buf bytes.Buffer
-
-	printf := func(format string, args ...interface{}) {
-		fmt.Fprintf(&buf, format, args...)
+// kvPrint writes a single dot-leader report line to buf
+func kvPrint(buf *bytes.Buffer, indentStr, keyStr, valStr string) {
+	dotLen := 30 - len(keyStr) - len(indentStr)
+	if dotLen < 2 {
+		dotLen = 2
 	}
+	dotStr := strings.Repeat(".", dotLen)
+	fmt.Fprintf(buf, "%s%s %s %s\n", indentStr, keyStr, dotStr, valStr)
+}
 
-	kvPrint := func(indentStr, keyStr, valStr string) {
-		dotLen := 30 - len(keyStr) - len(indentStr)
-		if dotLen < 2 {
-			dotLen = 2
+// kvSort sorts kvList by key
+func kvSort(kvList []kvType) {
+	sort.Slice(kvList, func(a, b int) bool {
+		return kvList[a].key < kvList[b].key
+	})
+}
+
+// kvSplit converts a list of "key=value" strings to a key/value list
+func kvSplit(list []string) (kvList []kvType) {
+	for _, kv := range list {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) == 2 {
+			kvList = append(kvList, kvType{key: pair[0], val: pair[1]})
 		}
-		dotStr := strings.Repeat(".", dotLen)
-		printf("%s%s %s %s\n", indentStr, keyStr, dotStr, valStr)
 	}
+	return
+}
 
-	printf("CGI for Caddy inspection page\n\n")
+// kvListPrint writes a heading followed by the sorted entries of kvList
+func kvListPrint(buf *bytes.Buffer, kvList []kvType, hdrStr string) {
+	fmt.Fprintf(buf, "%s\n", hdrStr)
+	kvSort(kvList)
+	for _, kv := range kvList {
+		kvPrint(buf, "  ", kv.key, kv.val)
+	}
+}
 
-	kvPrint("", "Executable", hnd.Path)
+// inspect responds with a report of the CGI execution that hnd would make
+// rather than making it. conds describes the request conditions that were met.
+func inspect(hnd hostType, conds []kvType, w http.ResponseWriter, req *http.Request, rep httpserver.Replacer) {
+	var buf bytes.Buffer
 
-	for j, arg := range hnd.Args {
-		kvPrint("  ", fmt.Sprintf("Arg %d", j+1), arg)
+	printf := func(format string, args ...interface{}) {
+		fmt.Fprintf(&buf, format, args...)
 	}
 
-	kvSort := func(kvList []kvType) {
-		sort.Slice(kvList, func(a, b int) bool {
-			return kvList[a].key < kvList[b].key
-		})
-	}
+	printf("CGI for Caddy inspection page\n\n")
 
-	split := func(list []string) (kvList []kvType) {
-		for _, kv := range list {
-			pair := strings.SplitN(kv, "=", 2)
-			if len(pair) == 2 {
-				kvList = append(kvList, kvType{key: pair[0], val: pair[1]})
-			}
-		}
-		return
+	kvPrint(&buf, "", "Executable", hnd.path)
+
+	for j, arg := range hnd.args {
+		kvPrint(&buf, "  ", fmt.Sprintf("Arg %d", j+1), arg)
 	}
 
 	osEnv := func(list []string) (kvList []kvType) {
@@ -82,22 +95,21 @@ func inspect(hnd cgi.Handler, w http.ResponseWriter, req *http.Request, rep http
 	repPrint := func(prms ...string) {
 		printf("Placeholders\n")
 		for _, prm := range prms {
-			kvPrint("  ", prm, rep.Replace(prm))
+			kvPrint(&buf, "  ", prm, rep.Replace(prm))
 		}
 	}
 
-	kvListPrint := func(kvList []kvType, hdrStr string) {
-		printf("%s\n", hdrStr)
-		kvSort(kvList)
-		for _, kv := range kvList {
-			kvPrint("  ", kv.key, kv.val)
+	if len(conds) > 0 {
+		printf("Conditions\n")
+		for _, cond := range conds {
+			kvPrint(&buf, "  ", cond.key, cond.val)
 		}
 	}
-
-	kvPrint("", "Root", hnd.Root)
-	kvPrint("", "Dir", hnd.Dir)
-	kvListPrint(split(hnd.Env), "Environment")
-	kvListPrint(osEnv(hnd.InheritEnv), "Inherited environment")
+	kvPrint(&buf, "", "Root", hnd.root)
+	kvPrint(&buf, "", "Dir", hnd.dir)
+	// The request body is not read, so form fields are not shown
+	kvListPrint(&buf, kvSplit(append(paramEnv(hnd.params, req, nil), hnd.env...)), "Environment")
+	kvListPrint(&buf, osEnv(hnd.inheritEnv), "Inherited environment")
 	repPrint("{.}", "{host}", "{match}", "{method}", "{root}", "{when}")
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
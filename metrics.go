@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are collected for every CGI execution in the process and reported
+// in the Prometheus text exposition format. Series are labelled with the rule
+// name so that their number is bounded by the configuration rather than by the
+// requests that arrive. Rules without a name are labelled with their position
+// in the configuration.
+
+// metricsBuckets holds the upper bounds, in seconds, of the histogram buckets
+var metricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogramType accumulates observations in cumulative buckets
+type histogramType struct {
+	counts []uint64 // one per bucket in metricsBuckets
+	count  uint64
+	sum    float64
+}
+
+func (hst *histogramType) observe(dur time.Duration) {
+	val := dur.Seconds()
+	if hst.counts == nil {
+		hst.counts = make([]uint64, len(metricsBuckets))
+	}
+	for j, bound := range metricsBuckets {
+		if val <= bound {
+			hst.counts[j]++
+		}
+	}
+	hst.count++
+	hst.sum += val
+}
+
+// ruleMetricsType holds the metrics of a single rule
+type ruleMetricsType struct {
+	executions uint64
+	running    int64
+	queued     int64
+	exits      map[string]uint64 // keyed by exit code
+	kills      map[string]uint64 // keyed by reason
+	bytesIn    uint64
+	bytesOut   uint64
+	duration   histogramType
+	ttfb       histogramType
+}
+
+// metricsType holds the metrics of all rules
+type metricsType struct {
+	mutex sync.Mutex
+	rules map[string]*ruleMetricsType
+}
+
+// metrics collects the metrics of all CGI executions in this process
+var metrics = metricsType{rules: make(map[string]*ruleMetricsType)}
+
+// rule returns the metrics of the named rule, creating them if needed. The
+// caller must hold the mutex.
+func (m *metricsType) rule(name string) (rm *ruleMetricsType) {
+	rm = m.rules[name]
+	if rm == nil {
+		rm = &ruleMetricsType{
+			exits: make(map[string]uint64),
+			kills: make(map[string]uint64),
+		}
+		m.rules[name] = rm
+	}
+	return
+}
+
+// begin records the start of an execution for the named rule. Here and in
+// the other recording methods, a rule without a name is not recorded, since
+// nothing would identify it reliably.
+func (m *metricsType) begin(name string) {
+	if name != "" {
+		m.mutex.Lock()
+		m.rule(name).running++
+		m.mutex.Unlock()
+	}
+}
+
+// wait records that a request for the named rule has begun (delta 1) or
+// stopped (delta -1) waiting for a process slot
+func (m *metricsType) wait(name string, delta int64) {
+	if name != "" {
+		m.mutex.Lock()
+		m.rule(name).queued += delta
+		m.mutex.Unlock()
+	}
+}
+
+// end records the outcome of an execution for the named rule
+func (m *metricsType) end(name string, run *runType) {
+	if name != "" {
+		m.mutex.Lock()
+		rm := m.rule(name)
+		rm.running--
+		rm.executions++
+		if run.state != nil {
+			rm.exits[strconv.Itoa(run.state.ExitCode())]++
+			rm.duration.observe(run.duration)
+			if run.ttfb > 0 {
+				rm.ttfb.observe(run.ttfb)
+			}
+		} else {
+			rm.exits["none"]++
+		}
+		if run.kill != "" {
+			rm.kills[run.kill]++
+		}
+		rm.bytesIn += uint64(run.bytesIn)
+		rm.bytesOut += uint64(run.bytesOut)
+		m.mutex.Unlock()
+	}
+}
+
+// labelEscape escapes a Prometheus label value
+func labelEscape(str string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(str)
+}
+
+// formatFloat formats a sample value
+func formatFloat(val float64) string {
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+// write reports all metrics to buf in the Prometheus text exposition format
+func (m *metricsType) write(buf *bytes.Buffer) {
+	printf := func(format string, args ...interface{}) {
+		fmt.Fprintf(buf, format, args...)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var names []string
+	for name := range m.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	family := func(name, kind, help string, each func(label string, rm *ruleMetricsType)) {
+		printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, ruleName := range names {
+			each(sprintf("rule=\"%s\"", labelEscape(ruleName)), m.rules[ruleName])
+		}
+	}
+
+	keyed := func(name, key string, mp map[string]uint64, label string) {
+		var keys []string
+		for k := range mp {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			printf("%s{%s,%s=\"%s\"} %d\n", name, label, key, labelEscape(k), mp[k])
+		}
+	}
+
+	histogram := func(name string, hst *histogramType, label string) {
+		for j, bound := range metricsBuckets {
+			var count uint64
+			if hst.counts != nil {
+				count = hst.counts[j]
+			}
+			printf("%s_bucket{%s,le=\"%s\"} %d\n", name, label, formatFloat(bound), count)
+		}
+		printf("%s_bucket{%s,le=\"+Inf\"} %d\n", name, label, hst.count)
+		printf("%s_sum{%s} %s\n", name, label, formatFloat(hst.sum))
+		printf("%s_count{%s} %d\n", name, label, hst.count)
+	}
+
+	family("cgi_executions_total", "counter", "Number of completed CGI executions.",
+		func(label string, rm *ruleMetricsType) {
+			printf("cgi_executions_total{%s} %d\n", label, rm.executions)
+		})
+	family("cgi_running", "gauge", "Number of CGI processes currently running.",
+		func(label string, rm *ruleMetricsType) {
+			printf("cgi_running{%s} %d\n", label, rm.running)
+		})
+	family("cgi_queued", "gauge", "Number of requests waiting for a CGI process slot.",
+		func(label string, rm *ruleMetricsType) {
+			printf("cgi_queued{%s} %d\n", label, rm.queued)
+		})
+	family("cgi_exits_total", "counter", "Number of CGI executions by exit code; -1 means terminated by a signal, none means not started.",
+		func(label string, rm *ruleMetricsType) {
+			keyed("cgi_exits_total", "code", rm.exits, label)
+		})
+	family("cgi_kills_total", "counter", "Number of CGI processes killed by the server, by reason.",
+		func(label string, rm *ruleMetricsType) {
+			keyed("cgi_kills_total", "reason", rm.kills, label)
+		})
+	family("cgi_request_bytes_total", "counter", "Request body bytes passed to CGI processes.",
+		func(label string, rm *ruleMetricsType) {
+			printf("cgi_request_bytes_total{%s} %d\n", label, rm.bytesIn)
+		})
+	family("cgi_response_bytes_total", "counter", "Response body bytes sent from CGI processes to clients.",
+		func(label string, rm *ruleMetricsType) {
+			printf("cgi_response_bytes_total{%s} %d\n", label, rm.bytesOut)
+		})
+	family("cgi_duration_seconds", "histogram", "Time from CGI process launch to exit.",
+		func(label string, rm *ruleMetricsType) {
+			histogram("cgi_duration_seconds", &rm.duration, label)
+		})
+	family("cgi_ttfb_seconds", "histogram", "Time from CGI process launch to first byte of output.",
+		func(label string, rm *ruleMetricsType) {
+			histogram("cgi_ttfb_seconds", &rm.ttfb, label)
+		})
+}
+
+// ServeHTTP reports the collected metrics
+func (m *metricsType) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	m.write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf.WriteTo(w)
+}
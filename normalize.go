@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Rules are matched against a normalized form of the request path. Go has
+// already decoded the percent-encoded characters of the path. Normalization
+// then resolves "." and ".." elements, collapses duplicate slashes and keeps a
+// trailing slash. A path that contains an encoded slash is reported as an
+// error, since the slash would otherwise be indistinguishable from a path
+// separator.
+
+// errEncodedSlash is reported for request paths that contain "%2F"
+var errEncodedSlash = errorf("request path contains an encoded slash")
+
+// normalizePath returns the normalized path of the request
+func normalizePath(r *http.Request) (str string, err error) {
+	if strings.Contains(strings.ToUpper(r.URL.EscapedPath()), "%2F") {
+		err = errEncodedSlash
+	}
+	str = r.URL.Path
+	if str == "" || str[0] != '/' {
+		str = "/" + str
+	}
+	trailing := strings.HasSuffix(str, "/")
+	str = path.Clean(str)
+	if trailing && str != "/" {
+		str += "/"
+	}
+	return
+}
+
+// lowerASCII returns str with its ASCII letters in lower case. Unlike
+// strings.ToLower, this preserves the length of str so that positions in the
+// result apply to the original.
+func lowerASCII(str string) string {
+	buf := []byte(str)
+	for j, ch := range buf {
+		if ch >= 'A' && ch <= 'Z' {
+			buf[j] = ch + ('a' - 'A')
+		}
+	}
+	return string(buf)
+}
+
+// foldRule prepares a rule with the ignore_case option for case-insensitive
+// matching. Glob patterns are compared in lower case with the lower case
+// request path, and regular expressions are recompiled with the "i" flag.
+func foldRule(rule *ruleType) {
+	for j, str := range rule.matches {
+		rule.matches[j] = lowerASCII(str)
+	}
+	rule.binPrefix = lowerASCII(rule.binPrefix)
+	rule.userPrefix = lowerASCII(rule.userPrefix)
+	for j, str := range rule.exceptions {
+		rule.exceptions[j] = lowerASCII(str)
+	}
+	for j, re := range rule.regexps {
+		rule.regexps[j] = regexp.MustCompile("(?i)" + re.String())
+	}
+}
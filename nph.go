@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// A non-parsed header (NPH) script writes the complete HTTP response,
+// beginning with the status line, and expects it to reach the client
+// unaltered. Once the status line has been validated, the client connection is
+// taken over and the script's output is copied to it as is. This is only
+// possible with HTTP/1.x; NPH requests that arrive by way of HTTP/2 are
+// rejected. Because the connection cannot be read once it has been taken over,
+// a request body is always spooled before the script starts.
+
+// nphStatusRe matches a valid NPH status line, capturing the status code
+var nphStatusRe = regexp.MustCompile(`^HTTP/1\.[01] ([1-5][0-9][0-9])( [^\r\n]*)?\r?\n$`)
+
+// nphLineMax is the maximum length of an NPH status line
+const nphLineMax = 1024
+
+// serveNPH runs the NPH CGI executable for the specified request and copies
+// its raw output to the client connection. The details of the execution are
+// returned.
+func (hst hostType) serveNPH(w http.ResponseWriter, req *http.Request) (run runType) {
+	hj, ok := w.(http.Hijacker)
+	switch {
+	case req.ProtoMajor != 1:
+		hst.logf("cgi: NPH script cannot respond to %s request", req.Proto)
+		run.status = http.StatusHTTPVersionNotSupported
+		w.WriteHeader(run.status)
+		w.Write([]byte("NPH scripts require HTTP/1.x.\n"))
+		return
+	case !ok:
+		hst.logf("cgi: NPH script cannot take over connection")
+		run.status = http.StatusInternalServerError
+		w.WriteHeader(run.status)
+		return
+	}
+
+	body, ok := hst.prepareBody(w, req, &run, true)
+	if !ok {
+		return
+	}
+	defer body.close()
+	req = body.request(req)
+	cmd, stdout := hst.start(req, body, &run)
+	if run.err != nil {
+		hst.logf("cgi: %s", run.err)
+		run.status = http.StatusInternalServerError
+		w.WriteHeader(run.status)
+		return
+	}
+	to := hst.watch(cmd)
+
+	var firstByte time.Time
+	lr := &limitReader{rdr: firstByteReader{rdr: stdout, when: &firstByte},
+		max: hst.maxResp, err: errResponseTooLarge}
+	rdr := bufio.NewReaderSize(lr, nphLineMax)
+	line, err := rdr.ReadSlice('\n')
+	run.header = time.Since(run.start)
+	if !firstByte.IsZero() {
+		run.ttfb = firstByte.Sub(run.start)
+	}
+	list := nphStatusRe.FindSubmatch(line)
+	if err == nil && list == nil {
+		err = errorf("cgi: invalid NPH status line: %q", line)
+	}
+	if err == nil {
+		run.status, _ = strconv.Atoi(string(list[1]))
+		conn, bufrw, hjErr := hj.Hijack()
+		err = hjErr
+		if err == nil {
+			_, err = bufrw.Write(line)
+			if err == nil {
+				run.bytesOut, err = io.Copy(bufrw, rdr)
+				if err == nil {
+					err = bufrw.Flush()
+				}
+			}
+			conn.Close()
+			if lr.exceeded() {
+				run.err = err
+				hst.logf("cgi: response exceeds %d bytes; process killed", hst.maxResp)
+				run.kill = "max_response_size"
+				cmd.Process.Kill()
+			} else if err != nil {
+				hst.logf("cgi: copy error: %s", err)
+				run.kill = "copy_error"
+				cmd.Process.Kill()
+			}
+		} else {
+			run.err = err
+			hst.logf("cgi: %s", err)
+			run.status = http.StatusInternalServerError
+			w.WriteHeader(run.status)
+		}
+	} else {
+		if err == io.EOF {
+			err = errorf("cgi: no NPH status line")
+		}
+		run.err = err
+		hst.logf("%s", err)
+		run.status = http.StatusBadGateway
+		if to.expired() {
+			run.status = http.StatusGatewayTimeout
+		}
+		w.WriteHeader(run.status)
+	}
+	io.Copy(ioutil.Discard, rdr)
+	stdout.Close()
+	cmd.Wait()
+	run.duration = time.Since(run.start)
+	run.state = cmd.ProcessState
+	hst.timedOut(to, &run)
+	return
+}
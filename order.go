@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"log"
+	"sort"
+)
+
+// By default, rules are tried in the order in which they appear in the
+// Caddyfile. The priority subdirective moves a rule ahead of rules with lower
+// priority. With "cgi order specificity", a request that matches several rules
+// of the same priority is handled by the one whose matching pattern is most
+// specific rather than by the first.
+
+// specificity returns a measure of how narrowly pattern matches: the number of
+// characters it contains other than wildcards and character classes
+func specificity(pattern string) (n int) {
+	for j := 0; j < len(pattern); j++ {
+		switch pattern[j] {
+		case '*', '?':
+		case '[':
+			for j < len(pattern) && pattern[j] != ']' {
+				j++
+			}
+		case '\\':
+			j++
+			n++
+		default:
+			n++
+		}
+	}
+	return
+}
+
+// sortRules orders rules by descending priority, keeping the configuration
+// order of rules with equal priority
+func sortRules(rules []ruleType) {
+	sort.SliceStable(rules, func(a, b int) bool {
+		return rules[a].priority > rules[b].priority
+	})
+}
+
+// covers returns true if every request path matched by pattern is also
+// matched by the glob pattern cover. This is the case if cover matches "/" or
+// a leading run of the literal elements of pattern, since match() tries each
+// of those prefixes of a request.
+func covers(cover, pattern string) (ok bool) {
+	ok, _ = globMatch(cover, "/")
+	list := literalElements(pattern)
+	for k := 2; k <= len(list) && !ok; k++ {
+		ok, _ = globMatch(cover, join(list[:k], "/"))
+	}
+	return
+}
+
+// unconditional returns true if rule matches on its glob patterns alone
+func unconditional(rule ruleType) bool {
+	return len(rule.exceptions) == 0 && len(rule.methods) == 0 && len(rule.hosts) == 0 &&
+		len(rule.headers) == 0 && len(rule.queries) == 0
+}
+
+// shadowed returns true if every request that later could match is handled
+// instead by earlier
+func shadowed(earlier, later ruleType) (ok bool) {
+	ok = unconditional(earlier) && len(later.regexps) == 0 && len(later.matches) > 0
+	for j := 0; j < len(later.matches) && ok; j++ {
+		ok = false
+		for k := 0; k < len(earlier.matches) && !ok; k++ {
+			ok = covers(earlier.matches[k], later.matches[j])
+		}
+	}
+	return
+}
+
+// shadowWarnings returns a warning for each rule that can never handle a
+// request because an earlier rule handles every request it matches. Rules
+// must already be sorted. In specificity order, only rules of higher priority
+// take precedence regardless of the pattern that matches.
+func shadowWarnings(rules []ruleType, specific bool) (list []string) {
+	for j := 1; j < len(rules); j++ {
+		found := false
+		for k := 0; k < j && !found; k++ {
+			if !specific || rules[k].priority > rules[j].priority {
+				found = shadowed(rules[k], rules[j])
+				if found {
+					list = append(list, sprintf("rule \"%s\" is shadowed by earlier rule \"%s\"",
+						ruleLabel(rules[j]), ruleLabel(rules[k])))
+				}
+			}
+		}
+	}
+	return
+}
+
+// logShadowWarnings reports shadowed rules in the Caddy log
+func logShadowWarnings(rules []ruleType, specific bool) {
+	for _, str := range shadowWarnings(rules, specific) {
+		log.Printf("[WARNING] cgi: %s", str)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// A rule may have the query string, URL-encoded form body and cookies of a
+// request decoded by the plugin and presented to the script as environment
+// variables named QUERY_name, FORM_name and COOKIE_name, each optionally
+// preceded by a configured prefix. Characters of a name other than ASCII
+// letters, digits and underscores are replaced with underscores, and the
+// values of a repeated name are joined with a separator. Variables beyond a
+// configured number, and values beyond a configured size, are left out.
+
+const (
+	paramCountDefault = 64      // variables per request, unless the rule specifies otherwise
+	paramSizeDefault  = 4096    // size of a variable's value, unless the rule specifies otherwise
+	paramSepDefault   = "\n"    // separator of repeated values, unless the rule specifies otherwise
+	paramFormMax      = 1 << 20 // size of the largest form body that is decoded
+)
+
+// paramSources lists, in order, the parts of a request that may be decoded
+var paramSources = []string{"query", "form", "cookie"}
+
+// paramNameChar maps a parameter name rune to its environment key form
+func paramNameChar(r rune) rune {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+		return r
+	}
+	return '_'
+}
+
+// paramsType holds the options with which a rule decodes request parameters
+type paramsType struct {
+	sources  []string // parts of the request to decode, in order
+	prefix   string   // prefix of variable names
+	sep      string   // separator of repeated values
+	maxCount int      // number of variables
+	maxSize  int      // size of a variable's value
+}
+
+// newParams returns the parameter options of rule, with defaults in place of
+// the limits it leaves unset
+func newParams(rule ruleType) (p paramsType) {
+	p.sources = rule.params
+	p.prefix = rule.paramPrefix
+	p.maxCount = rule.maxParams
+	if p.maxCount <= 0 {
+		p.maxCount = paramCountDefault
+	}
+	p.maxSize = int(rule.maxParamSize)
+	if p.maxSize <= 0 {
+		p.maxSize = paramSizeDefault
+	}
+	p.sep = rule.paramSep
+	if p.sep == "" {
+		p.sep = paramSepDefault
+	}
+	return
+}
+
+// decodes returns true if src is one of the parts of a request to decode
+func (p paramsType) decodes(src string) (ok bool) {
+	for j := 0; j < len(p.sources) && !ok; j++ {
+		ok = p.sources[j] == src
+	}
+	return
+}
+
+// formType returns true if ctype names a URL-encoded form
+func formType(ctype string) bool {
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// formBody returns true if the body of req is a URL-encoded form, of unknown
+// length or no larger than paramFormMax, that is to be decoded. Such a body is
+// spooled so that it can be read before the script is launched.
+func (p paramsType) formBody(req *http.Request) bool {
+	return p.decodes("form") && formType(req.Header.Get("Content-Type")) &&
+		req.ContentLength != 0 && req.ContentLength <= paramFormMax
+}
+
+// formValues returns the fields of the URL-encoded form in rdr, a prepared
+// body of size bytes, if it is no larger than paramFormMax. rdr is then
+// rewound for the script. Nothing is returned if rdr cannot be rewound.
+func formValues(rdr io.Reader, size int64) (values url.Values) {
+	if rs, ok := rdr.(io.ReadSeeker); ok && size > 0 && size <= paramFormMax {
+		buf, err := ioutil.ReadAll(io.LimitReader(rs, size))
+		if err == nil {
+			_, err = rs.Seek(0, io.SeekStart)
+			if err == nil {
+				values, _ = url.ParseQuery(string(buf))
+			}
+		}
+	}
+	return
+}
+
+// paramVars returns an environment variable, with prefix pfx, for each of
+// the names in values
+func paramVars(pfx string, values url.Values, sep string, maxSize int) (env []string) {
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	merged := make(url.Values)
+	var keys []string
+	for _, name := range names {
+		if name != "" {
+			key := strings.Map(paramNameChar, name)
+			if _, ok := merged[key]; !ok {
+				keys = append(keys, key)
+			}
+			merged[key] = append(merged[key], values[name]...)
+		}
+	}
+	for _, key := range keys {
+		val := cleanEnvStr(strings.Join(merged[key], sep))
+		// A query parameter named STRING must not replace QUERY_STRING
+		if len(val) <= maxSize && pfx+key != "QUERY_STRING" {
+			env = append(env, pfx+key+"="+val)
+		}
+	}
+	return
+}
+
+// paramEnv returns the environment variables that present the parameters of
+// r that p asks to have decoded. form holds the fields of the request body, if
+// it is a URL-encoded form.
+func paramEnv(p paramsType, r *http.Request, form url.Values) (env []string) {
+	for _, src := range p.sources {
+		var values url.Values
+		switch src {
+		case "query":
+			values, _ = url.ParseQuery(r.URL.RawQuery)
+		case "form":
+			values = form
+		case "cookie":
+			values = make(url.Values)
+			for _, ck := range r.Cookies() {
+				values[ck.Name] = append(values[ck.Name], ck.Value)
+			}
+		}
+		env = append(env, paramVars(p.prefix+strings.ToUpper(src)+"_", values, p.sep, p.maxSize)...)
+	}
+	if len(env) > p.maxCount {
+		env = env[:p.maxCount]
+	}
+	return
+}
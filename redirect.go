@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// A script that responds with a Location header holding a path and no Status
+// header asks, per RFC 3875, that the server respond as it would to a GET
+// request for that path. Such a local redirect is served again through the
+// full handler chain of the Caddy server that received the request, so that
+// rewrites, other cgi rules and static files all apply. Scripts run on behalf
+// of a redirected request receive REDIRECT_* variables that describe the
+// request that was redirected.
+
+// localRedirectMax is the maximum number of local redirects in a chain
+const localRedirectMax = 10
+
+// redirectCtxKey is the context key of the redirect state of a request
+type redirectCtxKey struct{}
+
+// redirectType describes the local redirects that led to a request
+type redirectType struct {
+	count int      // number of local redirects in the chain so far
+	env   []string // REDIRECT_* variables, as "key=value"
+}
+
+// redirectEnv returns the REDIRECT_* variables for r, which are empty unless
+// r is the result of a local redirect
+func redirectEnv(r *http.Request) (env []string) {
+	state, _ := r.Context().Value(redirectCtxKey{}).(redirectType)
+	return state.env
+}
+
+// localRedirect serves a GET request for the path and query of loc, in place
+// of r, with the handler of the server that received r or, failing that, with
+// h itself
+func (h handlerType) localRedirect(w http.ResponseWriter, r *http.Request, loc string) (code int, err error) {
+	var u *url.URL
+	state, _ := r.Context().Value(redirectCtxKey{}).(redirectType)
+	if state.count < localRedirectMax {
+		u, err = url.Parse(loc)
+	} else {
+		err = errorf("cgi: more than %d local redirects, last to %s", localRedirectMax, loc)
+	}
+	if err == nil {
+		state.count++
+		state.env = []string{
+			"REDIRECT_STATUS=200",
+			"REDIRECT_URL=" + r.URL.Path,
+			"REDIRECT_QUERY_STRING=" + r.URL.RawQuery,
+		}
+		nr := r.WithContext(context.WithValue(r.Context(), redirectCtxKey{}, state))
+		nu := *r.URL
+		nu.Path, nu.RawPath, nu.RawQuery, nu.Fragment = u.Path, u.RawPath, u.RawQuery, ""
+		nr.URL = &nu
+		nr.RequestURI = u.RequestURI()
+		nr.Method = http.MethodGet
+		nr.Header = make(http.Header)
+		for k, vv := range r.Header {
+			switch k {
+			case "Content-Length", "Content-Type", "Content-Encoding", "Transfer-Encoding":
+				// the redirected request has no body
+			default:
+				nr.Header[k] = vv
+			}
+		}
+		nr.Body = http.NoBody
+		nr.ContentLength = 0
+		nr.TransferEncoding = nil
+		srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server)
+		if ok && srv.Handler != nil {
+			srv.Handler.ServeHTTP(w, nr)
+		} else {
+			code, err = h.ServeHTTP(w, nr)
+		}
+	} else {
+		code = http.StatusInternalServerError
+	}
+	return
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"crypto/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// requestIDDefaultHeader is the header used to convey request IDs when no
+// other header is configured
+const requestIDDefaultHeader = "X-Request-ID"
+
+// requestIDMax is the maximum length of an acceptable incoming request ID
+const requestIDMax = 128
+
+// crockford is the alphabet used to encode ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulid returns a new universally unique lexicographically sortable
+// identifier for the specified time. See https://github.com/ulid/spec.
+func ulid(tm time.Time) string {
+	var id [16]byte
+	var out [26]byte
+
+	ms := uint64(tm.UnixNano() / int64(time.Millisecond))
+	for j := 5; j >= 0; j-- {
+		id[j] = byte(ms)
+		ms >>= 8
+	}
+	rand.Read(id[6:])
+	// 128 bits are encoded in 26 characters of 5 bits each; the leading
+	// character holds the 3 most significant bits
+	var acc uint
+	var bits uint
+	pos := len(out) - 1
+	for j := len(id) - 1; j >= 0; j-- {
+		acc |= uint(id[j]) << bits
+		bits += 8
+		for bits >= 5 {
+			out[pos] = crockford[acc&31]
+			pos--
+			acc >>= 5
+			bits -= 5
+		}
+	}
+	out[pos] = crockford[acc&31]
+	return string(out[:])
+}
+
+// validRequestID returns true if str is safe to use as a request ID in
+// environment variables, headers and log lines
+func validRequestID(str string) (ok bool) {
+	ok = len(str) > 0 && len(str) <= requestIDMax
+	for j := 0; j < len(str) && ok; j++ {
+		ch := str[j]
+		ok = ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' ||
+			strings.IndexByte("-_.:", ch) >= 0
+	}
+	return
+}
+
+// requestID returns the ID of the specified request. This is the value of the
+// request header hdrStr if it is acceptable, otherwise the ID assigned by the
+// Caddy request_id directive, if any, otherwise a newly generated ULID.
+func requestID(r *http.Request, hdrStr string) (id string) {
+	id = r.Header.Get(hdrStr)
+	if !validRequestID(id) {
+		id, _ = r.Context().Value(httpserver.RequestIDCtxKey).(string)
+		if !validRequestID(id) {
+			id = ulid(time.Now())
+		}
+	}
+	return
+}
+
+// prefixLines prepends prefix to each line of str
+func prefixLines(str, prefix string) string {
+	list := strings.Split(str, "\n")
+	for j, line := range list {
+		list[j] = prefix + line
+	}
+	return join(list, "\n")
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Rules are indexed by the literal path elements that begin their match
+// patterns. A pattern such as /reports/2020/*.lua can only match requests
+// whose paths begin with the elements "reports" and "2020", so the rule need
+// not be considered for other requests. Similarly, a rule with extension
+// handlers and no index scripts can only match a request with a path element
+// that ends in one of its extensions. Rules that have a pattern without a
+// literal leading element, a regular expression, index scripts for extension
+// handlers or a userdir prefix are considered for every request. The index
+// only narrows the set of candidate rules; each candidate is still fully
+// matched, in configuration order, so the first rule that matches is the one
+// that handles the request, just as without the index.
+
+// ruleIndexType is a node in a trie of literal path elements
+type ruleIndexType struct {
+	rules  []int                     // rules with a pattern whose literal prefix ends here
+	next   map[string]*ruleIndexType // child nodes keyed by path element
+	exts   map[string][]int          // handler rules keyed by extension; root node only
+	folded bool                      // true if some rule ignores case; root node only
+}
+
+// literalElements returns the leading elements of pattern that contain no
+// glob metacharacters
+func literalElements(pattern string) (list []string) {
+	for _, elem := range strings.Split(pattern, "/") {
+		if strings.ContainsAny(elem, `*?[\`) {
+			break
+		}
+		list = append(list, elem)
+	}
+	return
+}
+
+// newRuleIndex returns an index of the specified rules
+func newRuleIndex(rules []ruleType) (idx *ruleIndexType) {
+	idx = &ruleIndexType{}
+	for j, rule := range rules {
+		if rule.ignoreCase {
+			idx.folded = true
+		}
+		if len(rule.regexps) > 0 || (len(rule.exts) > 0 && len(rule.indexes) > 0) || rule.userDir != "" {
+			idx.rules = append(idx.rules, j)
+		} else {
+			for _, ext := range rule.exts {
+				extStr := ext.ext
+				if rule.ignoreCase {
+					extStr = lowerASCII(extStr)
+				}
+				if idx.exts == nil {
+					idx.exts = make(map[string][]int)
+				}
+				idx.exts[extStr] = append(idx.exts[extStr], j)
+			}
+		}
+		patterns := rule.matches
+		if rule.binDir != "" {
+			patterns = append(patterns[:len(patterns):len(patterns)], rule.binPrefix)
+		}
+		for _, pattern := range patterns {
+			nd := idx
+			for _, elem := range literalElements(pattern) {
+				child := nd.next[elem]
+				if child == nil {
+					child = &ruleIndexType{}
+					if nd.next == nil {
+						nd.next = make(map[string]*ruleIndexType)
+					}
+					nd.next[elem] = child
+				}
+				nd = child
+			}
+			nd.rules = append(nd.rules, j)
+		}
+	}
+	return
+}
+
+// walk appends to list the rules stored at each node along the path of
+// reqStr
+func (idx *ruleIndexType) walk(reqStr string, list []int) []int {
+	nd := idx
+	list = append(list, nd.rules...)
+	for _, elem := range strings.Split(reqStr, "/") {
+		nd = nd.next[elem]
+		if nd == nil {
+			break
+		}
+		list = append(list, nd.rules...)
+	}
+	return list
+}
+
+// extWalk appends to list the handler rules with an extension that ends an
+// element of reqStr. Extensions with characters outside of ASCII, which
+// strings.EqualFold may equate with ASCII ones, are compared with every rule
+// that has extension handlers.
+func (idx *ruleIndexType) extWalk(reqStr string, list []int) []int {
+	for _, elem := range strings.Split(reqStr, "/") {
+		extStr := filepath.Ext(elem)
+		if extStr != "" {
+			list = append(list, idx.exts[extStr]...)
+			if idx.folded {
+				lowerStr := lowerASCII(extStr)
+				if lowerStr != extStr {
+					list = append(list, idx.exts[lowerStr]...)
+				}
+				if strings.IndexFunc(extStr, func(r rune) bool { return r >= utf8.RuneSelf }) >= 0 {
+					for _, rules := range idx.exts {
+						list = append(list, rules...)
+					}
+				}
+			}
+		}
+	}
+	return list
+}
+
+// candidates returns, in configuration order, the indexes of the rules that
+// may match the request path reqStr. If idx is nil, all count rules are
+// returned.
+func (idx *ruleIndexType) candidates(reqStr string, count int) (list []int) {
+	if idx == nil {
+		list = make([]int, count)
+		for j := range list {
+			list[j] = j
+		}
+	} else {
+		// Consult each path that match() tries, from the request path up
+		// through its parents. Rules that ignore case are indexed by their
+		// lower case patterns.
+		var last string
+		str := reqStr
+		for last != str {
+			list = idx.walk(str, list)
+			if idx.folded {
+				list = idx.walk(lowerASCII(str), list)
+			}
+			last = str
+			str = filepath.Dir(str)
+		}
+		if len(idx.exts) > 0 {
+			list = idx.extWalk(reqStr, list)
+		}
+		sort.Ints(list)
+		out := list[:0]
+		for _, val := range list {
+			if len(out) == 0 || val != out[len(out)-1] {
+				out = append(out, val)
+			}
+		}
+		list = out
+	}
+	return
+}
@@ -0,0 +1,20 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package cgi
+
+import (
+	"os"
+)
+
+// processSignal returns an empty string on platforms that do not report
+// terminating signals
+func processSignal(state *os.ProcessState) string {
+	return ""
+}
+
+// processMaxRSS returns zero on platforms that do not report the resident set
+// size of child processes
+func processMaxRSS(state *os.ProcessState) int64 {
+	return 0
+}
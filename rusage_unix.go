@@ -0,0 +1,34 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package cgi
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// processSignal returns the name of the signal that terminated the process
+// described by state, or an empty string if the process exited normally
+func processSignal(state *os.ProcessState) (str string) {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		str = status.Signal().String()
+	}
+	return
+}
+
+// processMaxRSS returns the maximum resident set size, in bytes, of the
+// process described by state, or zero if it is not known
+func processMaxRSS(state *os.ProcessState) (size int64) {
+	usage, ok := state.SysUsage().(*syscall.Rusage)
+	if ok {
+		size = int64(usage.Maxrss)
+		if runtime.GOOS != "darwin" {
+			// Reported in kilobytes everywhere but macOS
+			size *= 1024
+		}
+	}
+	return
+}
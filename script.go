@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// A cgi_bin rule maps the path element that follows its prefix to a file in
+// its directory, in the manner of Apache's ScriptAlias. The file is executed
+// if it is a regular executable file; otherwise the request fails with status
+// 404. A handler rule, in the manner of Apache's AddHandler, runs files
+// beneath the site root through the interpreter mapped to their extension;
+// requests that do not resolve to such a file are left to other handlers.
+// Either kind of rule can run an index script for a request that names a
+// directory. A userdir rule works like cgi_bin for a script directory in each
+// user's home, reached by way of a "/~user" path prefix, and runs the scripts
+// it finds there as their owner.
+
+// lookupUser returns the account of the named user
+var lookupUser = user.Lookup
+
+// executable returns true if fileStr names a regular file that may be
+// executed. On Windows, any regular file is accepted.
+func executable(fileStr string) (ok bool) {
+	info, err := os.Stat(fileStr)
+	if err == nil {
+		ok = info.Mode().IsRegular() && (runtime.GOOS == "windows" || info.Mode()&0111 != 0)
+	}
+	return
+}
+
+// indexMatch completes a match whose script is a directory by finding the
+// first of the rule's index scripts in it; for extension handlers, only files
+// with a mapped extension qualify. ok is false if there is no such script. A
+// request for the directory without a trailing slash is marked for
+// redirection, as with Caddy's static file server; otherwise SCRIPT_NAME
+// becomes the directory and PATH_INFO is empty.
+func indexMatch(m *matchType, rule ruleType) (ok bool) {
+	info, err := os.Stat(m.script)
+	if err == nil && info.IsDir() && (m.suffix == "" || m.suffix == "/") {
+		for j := 0; j < len(rule.indexes) && !ok; j++ {
+			fileStr := filepath.Join(m.script, rule.indexes[j])
+			info, err = os.Stat(fileStr)
+			ok = err == nil && info.Mode().IsRegular() && (len(rule.exts) == 0 || handlerExt(fileStr, rule) != nil)
+			if ok {
+				m.script = fileStr
+				m.ext = handlerExt(fileStr, rule)
+			}
+		}
+		if ok {
+			if m.suffix == "" && !strings.HasSuffix(m.prefix, "/") {
+				m.redirect = true
+			} else {
+				m.prefix = strings.TrimSuffix(m.prefix, "/") + "/"
+				m.suffix = ""
+			}
+		}
+	}
+	return
+}
+
+// matchCgiBin returns true if the request path reqStr lies beneath the
+// cgi_bin prefix of rule, false otherwise. matchStr is reqStr, possibly in
+// lower case. If true is returned, it is followed by the details of the match,
+// including the file to execute.
+func matchCgiBin(reqStr, matchStr string, rule ruleType) (ok bool, m matchType) {
+	m.spec = specificity(rule.binPrefix)
+	if strings.HasPrefix(matchStr, rule.binPrefix+"/") {
+		pos := len(rule.binPrefix) + 1
+		end := strings.IndexByte(reqStr[pos:], '/')
+		if end < 0 {
+			end = len(reqStr)
+		} else {
+			end += pos
+		}
+		m.prefix, m.suffix = reqStr[:end], reqStr[end:]
+		// The prefix is claimed even when there is nothing to run, so that
+		// the request fails with 404 rather than falling through. An element
+		// that could name a file outside of the directory is not joined.
+		ok = true
+		elemStr := reqStr[pos:end]
+		if elemStr != "." && elemStr != ".." && !strings.ContainsRune(elemStr, '\\') &&
+			(end > pos || len(rule.indexes) > 0) {
+			m.script = filepath.Join(rule.binDir, filepath.FromSlash(elemStr))
+			if len(rule.indexes) > 0 {
+				// a directory without an index script is left to fail with 404
+				indexMatch(&m, rule)
+			}
+		}
+	} else if len(rule.indexes) > 0 && rule.binPrefix != "" && matchStr == rule.binPrefix {
+		m.prefix = reqStr
+		m.script = rule.binDir
+		ok = indexMatch(&m, rule)
+	}
+	return
+}
+
+// matchUserdir returns true if the request path reqStr has the form
+// /~user/prefix/script for the userdir prefix of rule and user is permitted,
+// false otherwise. matchStr is reqStr, possibly in lower case. The remainder
+// of the path is matched as it is by matchCgiBin, with the user's script
+// directory in place of a cgi_bin directory. If true is returned, the details
+// of the match include the user and, if the script may be run, the attributes
+// of its process.
+func matchUserdir(reqStr, matchStr string, rule ruleType) (ok bool, m matchType) {
+	if strings.HasPrefix(reqStr, "/~") {
+		end := strings.IndexByte(reqStr[2:], '/') + 2
+		if end > 2 && userPermitted(reqStr[2:end], rule) {
+			u, err := lookupUser(reqStr[2:end])
+			if err == nil {
+				bin := rule
+				bin.binPrefix = rule.userPrefix
+				bin.binDir = filepath.Join(u.HomeDir, rule.userDir)
+				ok, m = matchCgiBin(reqStr[end:], matchStr[end:], bin)
+				if ok {
+					m.prefix = reqStr[:end] + m.prefix
+					m.user = u
+					if !m.redirect && executable(m.script) {
+						m.attr, err = userAttr(u, m.script)
+						if err != nil {
+							log.Printf("[WARNING] cgi: %s", err)
+						}
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// userPermitted returns true if the scripts of the user name may be run by
+// rule
+func userPermitted(name string, rule ruleType) (ok bool) {
+	ok = len(rule.userAllow) == 0
+	if !ok {
+		ok, _ = globAny(rule.userAllow, name)
+	}
+	if ok {
+		deny, _ := globAny(rule.userDeny, name)
+		ok = !deny
+	}
+	return
+}
+
+// within returns true if fileStr, after resolving symbolic links, lies beneath
+// the directory rootStr, which must already be resolved
+func within(rootStr, fileStr string) (ok bool) {
+	realStr, err := filepath.EvalSymlinks(fileStr)
+	if err == nil {
+		var relStr string
+		relStr, err = filepath.Rel(rootStr, realStr)
+		if err == nil {
+			ok = relStr != ".." && !strings.HasPrefix(relStr, ".."+string(filepath.Separator))
+		}
+	}
+	return
+}
+
+// handlerExt returns the interpreter mapping of rule for fileStr, or nil if
+// the extension of fileStr is not mapped
+func handlerExt(fileStr string, rule ruleType) (ext *extType) {
+	extStr := filepath.Ext(fileStr)
+	for j := 0; j < len(rule.exts) && ext == nil; j++ {
+		if extStr == rule.exts[j].ext || (rule.ignoreCase && strings.EqualFold(extStr, rule.exts[j].ext)) {
+			ext = &rule.exts[j]
+		}
+	}
+	return
+}
+
+// matchHandler returns true if the request path reqStr resolves to an
+// existing file beneath rootStr whose extension is mapped by rule to an
+// interpreter, false otherwise. The path is resolved one element at a time;
+// the elements that follow the file become PATH_INFO. Files that resolve,
+// through symbolic links, to a location outside rootStr are refused.
+func matchHandler(rootStr, reqStr string, rule ruleType) (ok bool, m matchType) {
+	realRoot, err := filepath.EvalSymlinks(rootStr)
+	elems := strings.Split(strings.TrimPrefix(reqStr, "/"), "/")
+	fileStr := rootStr
+	for j := 0; j < len(elems) && elems[j] != "" && !ok && err == nil; j++ {
+		var info os.FileInfo
+		fileStr = filepath.Join(fileStr, elems[j])
+		info, err = os.Stat(fileStr)
+		if err == nil && !info.IsDir() {
+			ext := handlerExt(fileStr, rule)
+			if info.Mode().IsRegular() && ext != nil && within(realRoot, fileStr) {
+				ok = true
+				m.prefix = "/" + join(elems[:j+1], "/")
+				m.suffix = reqStr[len(m.prefix):]
+				m.script = fileStr
+				m.ext = ext
+			} else {
+				err = os.ErrNotExist
+			}
+		}
+	}
+	if !ok && err == nil && len(rule.indexes) > 0 {
+		// every element of the path names a directory
+		m.prefix = reqStr
+		m.script = fileStr
+		ok = indexMatch(&m, rule) && within(realRoot, m.script)
+	}
+	return
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A script that has decided to deliver a file, after checking permissions,
+// for example, can respond with an X-Sendfile header that names the file or an
+// X-Accel-Redirect header that holds an internal path mapped to a directory.
+// The script's output is then discarded and, once it has exited, the file is
+// served by the plugin with support for ranges, conditional requests and
+// content type detection. Only files beneath configured directories are
+// served.
+
+// sendfileHeader is the response header that names a file to send
+const sendfileHeader = "X-Sendfile"
+
+// accelHeader is the response header that holds the internal path of a file
+// to send
+const accelHeader = "X-Accel-Redirect"
+
+// statusWriter records the status and body size of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	count  int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (n int, err error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err = sw.ResponseWriter.Write(p)
+	sw.count += int64(n)
+	return
+}
+
+// sendRequested returns true if the script response with header hdr asks
+// that a file be sent and the rule permits this
+func (hst hostType) sendRequested(hdr http.Header) bool {
+	return (len(hst.sendDirs) > 0 && hdr.Get(sendfileHeader) != "") ||
+		(len(hst.accels) > 0 && hdr.Get(accelHeader) != "")
+}
+
+// sendPath returns the resolved name of the file that the script response
+// with header hdr asks to send, or an empty string if the file does not lie
+// beneath a permitted directory
+func (hst hostType) sendPath(hdr http.Header) (fileStr string) {
+	var dirs []string
+	if val := hdr.Get(sendfileHeader); val != "" && len(hst.sendDirs) > 0 {
+		if filepath.IsAbs(val) {
+			fileStr = filepath.Clean(val)
+			dirs = hst.sendDirs
+		}
+	} else if u, err := url.Parse(hdr.Get(accelHeader)); err == nil {
+		pathStr := path.Clean("/" + u.Path)
+		for _, accel := range hst.accels {
+			if fileStr == "" && strings.HasPrefix(pathStr, accel[0]+"/") {
+				fileStr = filepath.Join(accel[1], filepath.FromSlash(pathStr[len(accel[0]):]))
+				dirs = []string{accel[1]}
+			}
+		}
+	}
+	if fileStr != "" {
+		realStr, err := filepath.EvalSymlinks(fileStr)
+		fileStr = ""
+		for j := 0; j < len(dirs) && err == nil && fileStr == ""; j++ {
+			dirStr, dirErr := filepath.EvalSymlinks(dirs[j])
+			if dirErr == nil && within(dirStr, realStr) {
+				fileStr = realStr
+			}
+		}
+	}
+	return
+}
+
+// sendFile responds to req with the file the script response with header hdr
+// asks to send. Other headers of the script response are passed along; the
+// content type is determined from the file unless the script specifies it. If
+// the file cannot be sent, nothing is written so that the handler can return
+// status 404 to Caddy.
+func (hst hostType) sendFile(w http.ResponseWriter, req *http.Request, hdr http.Header, run *runType) {
+	var info os.FileInfo
+	var fl *os.File
+	fileStr := hst.sendPath(hdr)
+	err := os.ErrNotExist
+	if fileStr != "" {
+		fl, err = os.Open(fileStr)
+		if err == nil {
+			defer fl.Close()
+			info, err = fl.Stat()
+			if err == nil && !info.Mode().IsRegular() {
+				err = os.ErrNotExist
+			}
+		}
+	}
+	if err == nil {
+		for k, vv := range hdr {
+			if k != sendfileHeader && k != "Content-Length" && !strings.HasPrefix(k, "X-Accel-") {
+				w.Header()[k] = vv
+			}
+		}
+		if hst.timing {
+			setTimingHeaders(w.Header(), run, hst.timingAll)
+		}
+		sw := statusWriter{ResponseWriter: w}
+		http.ServeContent(&sw, req, info.Name(), info.ModTime(), fl)
+		run.status, run.bytesOut = sw.status, sw.count
+		if run.status == 0 {
+			run.status = http.StatusOK
+		}
+	} else {
+		hst.logf("cgi: cannot send file requested by script: %s%s",
+			hdr.Get(sendfileHeader), hdr.Get(accelHeader))
+		run.status = http.StatusNotFound
+		run.unsent = true
+	}
+}
@@ -17,8 +17,14 @@
 package cgi
 
 import (
+	"net"
+	"net/http"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
@@ -39,15 +45,14 @@ func configureServer(ctrl *caddy.Controller, cfg *httpserver.SiteConfig) (err er
 
 	root, err = filepath.Abs(cfg.Root)
 	if err == nil {
-		var rules []ruleType
-		rules, err = cgiParse(ctrl)
+		var hnd handlerType
+		hnd, err = cgiParse(ctrl)
 		if err == nil {
+			hnd.root = root
 			cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
-				return handlerType{
-					next:  next,
-					rules: rules,
-					root:  root,
-				}
+				h := hnd
+				h.next = next
+				return h
 			})
 		}
 	}
@@ -74,6 +79,20 @@ func parseDir(rule *ruleType, args []string) (err error) {
 	return
 }
 
+// parseName parses a "name" line
+func parseName(rule *ruleType, args []string) (err error) {
+	if len(args) == 1 {
+		if rule.name == "" {
+			rule.name = args[0]
+		} else {
+			err = errorf("\"name\" may only be specified once per block")
+		}
+	} else {
+		err = errorf("expecting exactly one argument to follow \"name\"")
+	}
+	return
+}
+
 // parseExec parses an "exec" line
 func parseExec(rule *ruleType, args []string) (err error) {
 	if len(args) > 0 {
@@ -95,6 +114,24 @@ func parseMatch(rule *ruleType, args []string) (err error) {
 	return
 }
 
+// parseMatchRegexp parses a match_regexp line
+func parseMatchRegexp(rule *ruleType, args []string) (err error) {
+	if len(args) > 0 {
+		for j := 0; j < len(args) && err == nil; j++ {
+			var re *regexp.Regexp
+			re, err = regexp.Compile(args[j])
+			if err == nil {
+				rule.regexps = append(rule.regexps, re)
+			} else {
+				err = errorf("invalid regular expression \"%s\": %s", args[j], err)
+			}
+		}
+	} else {
+		err = errorf("expecting at least one argument to follow \"match_regexp\"")
+	}
+	return
+}
+
 // parseExcept parses a match line
 func parseExcept(rule *ruleType, args []string) (err error) {
 	if len(args) > 0 {
@@ -105,6 +142,199 @@ func parseExcept(rule *ruleType, args []string) (err error) {
 	return
 }
 
+// parseGlobs validates the glob patterns in list
+func parseGlobs(list []string) (err error) {
+	for j := 0; j < len(list) && err == nil; j++ {
+		_, err = path.Match(list[j], "")
+		if err != nil {
+			err = errorf("invalid pattern \"%s\": %s", list[j], err)
+		}
+	}
+	return
+}
+
+// parseMethods parses a line beginning with the "methods" subdirective
+func parseMethods(rule *ruleType, args []string) (err error) {
+	if len(args) > 0 {
+		for _, str := range args {
+			rule.methods = append(rule.methods, strings.ToUpper(str))
+		}
+	} else {
+		err = errorf("expecting at least one method to follow \"methods\"")
+	}
+	return
+}
+
+// parseHost parses a line beginning with the "host" subdirective
+func parseHost(rule *ruleType, args []string) (err error) {
+	if len(args) > 0 {
+		for j, str := range args {
+			args[j] = strings.ToLower(str)
+		}
+		err = parseGlobs(args)
+		if err == nil {
+			rule.hosts = append(rule.hosts, args...)
+		}
+	} else {
+		err = errorf("expecting at least one host pattern to follow \"host\"")
+	}
+	return
+}
+
+// parseHeader parses a line beginning with the "header" subdirective
+func parseHeader(rule *ruleType, args []string) (err error) {
+	if len(args) > 0 {
+		err = parseGlobs(args[1:])
+		if err == nil {
+			cond := []string{http.CanonicalHeaderKey(args[0])}
+			rule.headers = append(rule.headers, append(cond, args[1:]...))
+		}
+	} else {
+		err = errorf("expecting header name to follow \"header\"")
+	}
+	return
+}
+
+// parseQuery parses a line beginning with the "query" subdirective. Each
+// argument is a condition of the form key or key=pattern.
+func parseQuery(rule *ruleType, args []string) (err error) {
+	if len(args) > 0 {
+		for j := 0; j < len(args) && err == nil; j++ {
+			cond := strings.SplitN(args[j], "=", 2)
+			if cond[0] == "" {
+				err = errorf("expecting key or key=value format, got \"%s\"", args[j])
+			} else {
+				err = parseGlobs(cond[1:])
+				if err == nil {
+					rule.queries = append(rule.queries, cond)
+				}
+			}
+		}
+	} else {
+		err = errorf("expecting at least one parameter to follow \"query\"")
+	}
+	return
+}
+
+// parsePriority parses a line beginning with the "priority" subdirective
+func parsePriority(rule *ruleType, args []string) (err error) {
+	if len(args) == 1 {
+		if !rule.hasPriority {
+			rule.priority, err = strconv.Atoi(args[0])
+			if err == nil {
+				rule.hasPriority = true
+			} else {
+				err = errorf("expecting integer to follow \"priority\", got \"%s\"", args[0])
+			}
+		} else {
+			err = errorf("\"priority\" may only be specified once per block")
+		}
+	} else {
+		err = errorf("expecting exactly one argument to follow \"priority\"")
+	}
+	return
+}
+
+// parseCgiBin parses a line beginning with the "cgi_bin" subdirective
+func parseCgiBin(rule *ruleType, args []string) (err error) {
+	if len(args) == 2 {
+		if rule.binDir == "" {
+			if strings.HasPrefix(args[0], "/") {
+				rule.binPrefix = strings.TrimRight(args[0], "/")
+				rule.binDir, err = filepath.Abs(args[1])
+			} else {
+				err = errorf("expecting \"cgi_bin\" prefix to begin with \"/\", got \"%s\"", args[0])
+			}
+		} else {
+			err = errorf("\"cgi_bin\" may only be specified once per block")
+		}
+	} else {
+		err = errorf("expecting a path prefix and a directory to follow \"cgi_bin\"")
+	}
+	return
+}
+
+// parseUserdir parses a line beginning with the "userdir" subdirective
+func parseUserdir(rule *ruleType, args []string) (err error) {
+	if len(args) == 2 {
+		if rule.userDir == "" {
+			if !strings.HasPrefix(args[0], "/") {
+				err = errorf("expecting \"userdir\" prefix to begin with \"/\", got \"%s\"", args[0])
+			} else if filepath.IsAbs(args[1]) || args[1] == ".." ||
+				strings.HasPrefix(args[1], ".."+string(filepath.Separator)) {
+				err = errorf("expecting \"userdir\" directory to lie within the home directory, got \"%s\"", args[1])
+			} else {
+				rule.userPrefix = strings.TrimRight(args[0], "/")
+				rule.userDir = filepath.Clean(args[1])
+			}
+		} else {
+			err = errorf("\"userdir\" may only be specified once per block")
+		}
+	} else {
+		err = errorf("expecting a path prefix and a directory to follow \"userdir\"")
+	}
+	return
+}
+
+// parseUsers parses a line beginning with the "userdir_allow" or
+// "userdir_deny" subdirective
+func parseUsers(list *[]string, val string, args []string) (err error) {
+	if len(args) > 0 {
+		for j := 0; j < len(args) && err == nil; j++ {
+			_, err = path.Match(args[j], "")
+		}
+		if err == nil {
+			*list = append(*list, args...)
+		} else {
+			err = errorf("invalid user name pattern following \"%s\": %s", val, err)
+		}
+	} else {
+		err = errorf("expecting at least one user name to follow \"%s\"", val)
+	}
+	return
+}
+
+// parseHandler parses a line beginning with the "handler" subdirective
+func parseHandler(rule *ruleType, args []string) (err error) {
+	if len(args) >= 2 {
+		if len(args[0]) > 1 && args[0][0] == '.' && !strings.ContainsAny(args[0][1:], "./") {
+			rule.exts = append(rule.exts, extType{ext: args[0], exe: args[1], args: args[2:]})
+		} else {
+			err = errorf("expecting extension such as \".py\" to follow \"handler\", got \"%s\"", args[0])
+		}
+	} else {
+		err = errorf("expecting an extension and an interpreter to follow \"handler\"")
+	}
+	return
+}
+
+// parseIndex parses a line beginning with the "index" subdirective
+func parseIndex(rule *ruleType, args []string) (err error) {
+	if len(args) > 0 {
+		for j := 0; j < len(args) && err == nil; j++ {
+			if args[j] == "." || args[j] == ".." || strings.ContainsAny(args[j], `/\`) {
+				err = errorf("expecting file name to follow \"index\", got \"%s\"", args[j])
+			}
+		}
+		if err == nil {
+			rule.indexes = append(rule.indexes, args...)
+		}
+	} else {
+		err = errorf("expecting at least one file name to follow \"index\"")
+	}
+	return
+}
+
+// parseIgnoreCase parses a line beginning with the "ignore_case" subdirective
+func parseIgnoreCase(rule *ruleType, args []string) (err error) {
+	if len(args) == 0 {
+		rule.ignoreCase = true
+	} else {
+		err = errorf("not expecting any arguments to follow \"ignore_case\"")
+	}
+	return
+}
+
 // parseInspect parses a line beginning with the "inspect" subdirective
 func parseInspect(rule *ruleType, args []string) (err error) {
 	if len(args) == 0 {
@@ -115,6 +345,356 @@ func parseInspect(rule *ruleType, args []string) (err error) {
 	return
 }
 
+// parseDebug parses a line beginning with the "debug" subdirective
+func parseDebug(rule *ruleType, args []string) (err error) {
+	if !rule.debug {
+		rule.debug = true
+		if len(args) == 0 {
+			args = debugDefaultNets
+		}
+		for j := 0; j < len(args) && err == nil; j++ {
+			var ipNet *net.IPNet
+			ipNet, err = parseNet(args[j])
+			if err == nil {
+				rule.debugNets = append(rule.debugNets, ipNet)
+			}
+		}
+	} else {
+		err = errorf("\"debug\" may only be specified once per block")
+	}
+	return
+}
+
+// parseTiming parses a line beginning with the "timing_headers" subdirective
+func parseTiming(rule *ruleType, args []string) (err error) {
+	switch {
+	case len(args) == 0:
+		rule.timing = true
+	case len(args) == 1 && args[0] == "all":
+		rule.timing = true
+		rule.timingAll = true
+	default:
+		err = errorf("expecting nothing or \"all\" to follow \"timing_headers\"")
+	}
+	return
+}
+
+// parseFallthrough parses a line beginning with the "fallthrough" subdirective
+func parseFallthrough(rule *ruleType, args []string) (err error) {
+	if !rule.fallThrough {
+		rule.fallThrough = true
+		for j := 0; j < len(args) && err == nil; j++ {
+			var code int
+			code, err = strconv.Atoi(args[j])
+			if err == nil && code >= 100 && code <= 599 {
+				rule.fallStatuses = append(rule.fallStatuses, code)
+			} else {
+				err = errorf("expecting HTTP status code to follow \"fallthrough\", got \"%s\"", args[j])
+			}
+		}
+	} else {
+		err = errorf("\"fallthrough\" may only be specified once per block")
+	}
+	return
+}
+
+// parseSendfile parses a line beginning with the "sendfile" subdirective
+func parseSendfile(rule *ruleType, args []string) (err error) {
+	if len(args) > 0 {
+		for j := 0; j < len(args) && err == nil; j++ {
+			var dirStr string
+			dirStr, err = filepath.Abs(args[j])
+			if err == nil {
+				rule.sendDirs = append(rule.sendDirs, dirStr)
+			}
+		}
+	} else {
+		err = errorf("expecting at least one directory to follow \"sendfile\"")
+	}
+	return
+}
+
+// parseAccelRedirect parses a line beginning with the "accel_redirect"
+// subdirective
+func parseAccelRedirect(rule *ruleType, args []string) (err error) {
+	if len(args) == 2 {
+		if strings.HasPrefix(args[0], "/") {
+			var dirStr string
+			dirStr, err = filepath.Abs(args[1])
+			if err == nil {
+				rule.accels = append(rule.accels, [2]string{strings.TrimRight(args[0], "/"), dirStr})
+			}
+		} else {
+			err = errorf("expecting \"accel_redirect\" prefix to begin with \"/\", got \"%s\"", args[0])
+		}
+	} else {
+		err = errorf("expecting a path prefix and a directory to follow \"accel_redirect\"")
+	}
+	return
+}
+
+// parseNPH parses a line beginning with the "nph" subdirective
+func parseNPH(rule *ruleType, args []string) (err error) {
+	if len(args) == 0 {
+		rule.nph = true
+	} else {
+		err = errorf("not expecting any arguments to follow \"nph\"")
+	}
+	return
+}
+
+// parseSize parses a size in bytes, optionally followed by K, M or G for
+// multiples of 1024
+func parseSize(str string) (size int64, err error) {
+	mult := int64(1)
+	numStr := strings.TrimRight(strings.ToUpper(str), "B")
+	if numStr != "" {
+		switch numStr[len(numStr)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			numStr = numStr[:len(numStr)-1]
+		}
+	}
+	size, err = strconv.ParseInt(numStr, 10, 64)
+	if err == nil && size > 0 && size <= (1<<62)/mult {
+		size *= mult
+	} else {
+		err = errorf("expecting positive size such as \"512K\" or \"10M\", got \"%s\"", str)
+	}
+	return
+}
+
+// parseMaxBody parses a line beginning with the "max_body_size" subdirective
+func parseMaxBody(rule *ruleType, args []string) (err error) {
+	if len(args) == 1 {
+		if rule.maxBody == 0 {
+			rule.maxBody, err = parseSize(args[0])
+		} else {
+			err = errorf("\"max_body_size\" may only be specified once per block")
+		}
+	} else {
+		err = errorf("expecting a size to follow \"max_body_size\"")
+	}
+	return
+}
+
+// parseMaxResponse parses a line beginning with the "max_response_size"
+// subdirective
+func parseMaxResponse(rule *ruleType, args []string) (err error) {
+	if len(args) == 1 {
+		if rule.maxResponse == 0 {
+			rule.maxResponse, err = parseSize(args[0])
+		} else {
+			err = errorf("\"max_response_size\" may only be specified once per block")
+		}
+	} else {
+		err = errorf("expecting a size to follow \"max_response_size\"")
+	}
+	return
+}
+
+// parseSpool parses a line beginning with the "spool_body" subdirective
+func parseSpool(rule *ruleType, args []string) (err error) {
+	switch {
+	case rule.spool:
+		err = errorf("\"spool_body\" may only be specified once per block")
+	case len(args) > 1:
+		err = errorf("expecting at most a size to follow \"spool_body\"")
+	case len(args) == 1:
+		rule.spoolMem, err = parseSize(args[0])
+	}
+	rule.spool = true
+	return
+}
+
+// parseDecodeBody parses a line beginning with the "decode_request_body"
+// subdirective
+func parseDecodeBody(rule *ruleType, args []string) (err error) {
+	if len(args) == 0 {
+		rule.decodeBody = true
+	} else {
+		err = errorf("not expecting any arguments to follow \"decode_request_body\"")
+	}
+	return
+}
+
+// parseUploads parses a line beginning with the "uploads" subdirective
+func parseUploads(rule *ruleType, args []string) (err error) {
+	switch {
+	case rule.uploads != "":
+		err = errorf("\"uploads\" may only be specified once per block")
+	case len(args) == 0:
+		rule.uploads = "env"
+	case len(args) == 1 && (args[0] == "env" || args[0] == "json"):
+		rule.uploads = args[0]
+	default:
+		err = errorf("expecting at most \"env\" or \"json\" to follow \"uploads\"")
+	}
+	return
+}
+
+// parseMaxUploadFiles parses a line beginning with the "max_upload_files"
+// subdirective
+func parseMaxUploadFiles(rule *ruleType, args []string) (err error) {
+	if len(args) == 1 {
+		if rule.uploadFiles == 0 {
+			rule.uploadFiles, err = strconv.Atoi(args[0])
+			if err != nil || rule.uploadFiles <= 0 {
+				err = errorf("expecting positive count to follow \"max_upload_files\", got \"%s\"", args[0])
+			}
+		} else {
+			err = errorf("\"max_upload_files\" may only be specified once per block")
+		}
+	} else {
+		err = errorf("expecting a count to follow \"max_upload_files\"")
+	}
+	return
+}
+
+// parseMaxUploadSize parses a line beginning with the "max_upload_size"
+// subdirective
+func parseMaxUploadSize(rule *ruleType, args []string) (err error) {
+	if len(args) == 1 {
+		if rule.uploadMax == 0 {
+			rule.uploadMax, err = parseSize(args[0])
+		} else {
+			err = errorf("\"max_upload_size\" may only be specified once per block")
+		}
+	} else {
+		err = errorf("expecting a size to follow \"max_upload_size\"")
+	}
+	return
+}
+
+// parseParams parses a line beginning with the "decode_params" subdirective
+func parseParams(rule *ruleType, args []string) (err error) {
+	if len(rule.params) == 0 {
+		if len(args) == 0 {
+			args = paramSources
+		}
+		for _, src := range paramSources {
+			for _, arg := range args {
+				if arg == src {
+					rule.params = append(rule.params, src)
+					break
+				}
+			}
+		}
+		for j := 0; j < len(args) && err == nil; j++ {
+			if args[j] != "query" && args[j] != "form" && args[j] != "cookie" {
+				err = errorf("expecting \"query\", \"form\" or \"cookie\" to follow \"decode_params\", got \"%s\"", args[j])
+			}
+		}
+	} else {
+		err = errorf("\"decode_params\" may only be specified once per block")
+	}
+	return
+}
+
+// parseParamPrefix parses a line beginning with the "param_prefix"
+// subdirective
+func parseParamPrefix(rule *ruleType, args []string) (err error) {
+	switch {
+	case rule.paramPrefix != "":
+		err = errorf("\"param_prefix\" may only be specified once per block")
+	case len(args) != 1 || args[0] == "":
+		err = errorf("expecting a prefix to follow \"param_prefix\"")
+	case strings.Map(paramNameChar, args[0]) != args[0]:
+		err = errorf("expecting only letters, digits and underscores in \"param_prefix\", got \"%s\"", args[0])
+	default:
+		rule.paramPrefix = args[0]
+	}
+	return
+}
+
+// parseParamSep parses a line beginning with the "param_separator"
+// subdirective
+func parseParamSep(rule *ruleType, args []string) (err error) {
+	switch {
+	case rule.paramSep != "":
+		err = errorf("\"param_separator\" may only be specified once per block")
+	case len(args) != 1 || args[0] == "":
+		err = errorf("expecting a separator to follow \"param_separator\"")
+	default:
+		rule.paramSep = args[0]
+	}
+	return
+}
+
+// parseMaxParams parses a line beginning with the "max_params" subdirective
+func parseMaxParams(rule *ruleType, args []string) (err error) {
+	if len(args) == 1 {
+		if rule.maxParams == 0 {
+			rule.maxParams, err = strconv.Atoi(args[0])
+			if err != nil || rule.maxParams <= 0 {
+				err = errorf("expecting positive count to follow \"max_params\", got \"%s\"", args[0])
+			}
+		} else {
+			err = errorf("\"max_params\" may only be specified once per block")
+		}
+	} else {
+		err = errorf("expecting a count to follow \"max_params\"")
+	}
+	return
+}
+
+// parseMaxParamSize parses a line beginning with the "max_param_size"
+// subdirective
+func parseMaxParamSize(rule *ruleType, args []string) (err error) {
+	if len(args) == 1 {
+		if rule.maxParamSize == 0 {
+			rule.maxParamSize, err = parseSize(args[0])
+		} else {
+			err = errorf("\"max_param_size\" may only be specified once per block")
+		}
+	} else {
+		err = errorf("expecting a size to follow \"max_param_size\"")
+	}
+	return
+}
+
+// parseTimeout parses a line beginning with the "timeout" subdirective
+func parseTimeout(rule *ruleType, args []string) (err error) {
+	if len(args) == 1 {
+		if rule.timeout == 0 {
+			rule.timeout, err = time.ParseDuration(args[0])
+			if err != nil || rule.timeout <= 0 {
+				err = errorf("expecting positive duration such as \"30s\" to follow \"timeout\", got \"%s\"", args[0])
+			}
+		} else {
+			err = errorf("\"timeout\" may only be specified once per block")
+		}
+	} else {
+		err = errorf("expecting a duration to follow \"timeout\"")
+	}
+	return
+}
+
+// parseMaxRunning parses a line beginning with the "max_running" subdirective
+func parseMaxRunning(rule *ruleType, args []string) (err error) {
+	if len(args) == 1 {
+		if rule.maxRunning == 0 {
+			rule.maxRunning, err = strconv.Atoi(args[0])
+			if err == nil && rule.maxRunning > 0 {
+				rule.slots = make(chan struct{}, rule.maxRunning)
+			} else {
+				err = errorf("expecting positive count to follow \"max_running\", got \"%s\"", args[0])
+			}
+		} else {
+			err = errorf("\"max_running\" may only be specified once per block")
+		}
+	} else {
+		err = errorf("expecting a count to follow \"max_running\"")
+	}
+	return
+}
+
 // parseAllEnv parses a line beginning with the "pass_all_env" subdirective
 func parseAllEnv(rule *ruleType, args []string) (err error) {
 	if len(args) == 0 {
@@ -144,10 +724,38 @@ func parseEnv(envs *[][2]string, args []string) (err error) {
 
 func parseToken(val string, rule *ruleType, args []string, loop *bool) (err error) {
 	switch val {
+	case "name": // [0..1]
+		err = parseName(rule, args)
+	case "priority": // [0..1]
+		err = parsePriority(rule, args)
 	case "match": // [1..n]
 		err = parseMatch(rule, args)
+	case "cgi_bin": // [0..1]
+		err = parseCgiBin(rule, args)
+	case "handler": // [0..n]
+		err = parseHandler(rule, args)
+	case "userdir": // [0..1]
+		err = parseUserdir(rule, args)
+	case "userdir_allow": // [0..n]
+		err = parseUsers(&rule.userAllow, val, args)
+	case "userdir_deny": // [0..n]
+		err = parseUsers(&rule.userDeny, val, args)
+	case "index": // [1..n]
+		err = parseIndex(rule, args)
+	case "match_regexp": // [1..n]
+		err = parseMatchRegexp(rule, args)
 	case "except": // [0..n]
 		err = parseExcept(rule, args)
+	case "ignore_case": // [0]
+		err = parseIgnoreCase(rule, args)
+	case "methods": // [1..n]
+		err = parseMethods(rule, args)
+	case "host": // [1..n]
+		err = parseHost(rule, args)
+	case "header": // [1..n]
+		err = parseHeader(rule, args)
+	case "query": // [1..n]
+		err = parseQuery(rule, args)
 	case "exec": // [1]
 		err = parseExec(rule, args)
 	case "env": // [0..n]
@@ -156,18 +764,95 @@ func parseToken(val string, rule *ruleType, args []string, loop *bool) (err erro
 		rule.passEnvs = append(rule.passEnvs, args...)
 	case "empty_env": // [0..n]
 		rule.emptyEnvs = append(rule.emptyEnvs, args...)
+	case "decode_params": // [0..1]
+		err = parseParams(rule, args)
+	case "param_prefix": // [0..1]
+		err = parseParamPrefix(rule, args)
+	case "param_separator": // [0..1]
+		err = parseParamSep(rule, args)
+	case "max_params": // [0..1]
+		err = parseMaxParams(rule, args)
+	case "max_param_size": // [0..1]
+		err = parseMaxParamSize(rule, args)
 	case "pass_all_env": // [0]
 		err = parseAllEnv(rule, args)
 	case "dir": // [1]
 		err = parseDir(rule, args)
 	case "inspect": // [0]
 		err = parseInspect(rule, args)
+	case "debug": // [0..n]
+		err = parseDebug(rule, args)
+	case "fallthrough": // [0..1]
+		err = parseFallthrough(rule, args)
+	case "sendfile": // [0..n]
+		err = parseSendfile(rule, args)
+	case "accel_redirect": // [0..n]
+		err = parseAccelRedirect(rule, args)
+	case "nph": // [0..1]
+		err = parseNPH(rule, args)
+	case "max_body_size": // [0..1]
+		err = parseMaxBody(rule, args)
+	case "max_response_size": // [0..1]
+		err = parseMaxResponse(rule, args)
+	case "timeout": // [0..1]
+		err = parseTimeout(rule, args)
+	case "max_running": // [0..1]
+		err = parseMaxRunning(rule, args)
+	case "spool_body": // [0..1]
+		err = parseSpool(rule, args)
+	case "decode_request_body": // [0..1]
+		err = parseDecodeBody(rule, args)
+	case "uploads": // [0..1]
+		err = parseUploads(rule, args)
+	case "max_upload_files": // [0..1]
+		err = parseMaxUploadFiles(rule, args)
+	case "max_upload_size": // [0..1]
+		err = parseMaxUploadSize(rule, args)
+	case "timing_headers": // [0..1]
+		err = parseTiming(rule, args)
 	case "}":
 		*loop = false
 	}
 	return
 }
 
+// checkRule verifies that a rule parsed from a block is complete and prepares
+// it for matching
+func checkRule(rule *ruleType) (err error) {
+	modes := 0
+	for _, set := range []bool{rule.binDir != "", len(rule.exts) > 0, rule.userDir != ""} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 0 {
+		if len(rule.matches) > 0 || len(rule.regexps) > 0 || rule.exe != "" || modes > 1 {
+			err = errorf("\"cgi_bin\", \"handler\" and \"userdir\" may not be combined with each " +
+				"other or with \"match\", \"match_regexp\" or \"exec\"")
+		}
+	} else if len(rule.indexes) > 0 {
+		err = errorf("\"index\" requires \"cgi_bin\", \"handler\" or \"userdir\"")
+	} else if len(rule.userAllow) > 0 || len(rule.userDeny) > 0 {
+		err = errorf("\"userdir_allow\" and \"userdir_deny\" require \"userdir\"")
+	} else if len(rule.matches) == 0 && len(rule.regexps) == 0 {
+		err = errorf("block must contain at least one \"match\" or \"match_regexp\" subdirective")
+	} else if rule.exe == "" {
+		err = errorf("block must contain an \"exec\" subdirective")
+	}
+	if err == nil && rule.uploads == "" && (rule.uploadFiles > 0 || rule.uploadMax > 0) {
+		err = errorf("\"max_upload_files\" and \"max_upload_size\" require \"uploads\"")
+	}
+	if err == nil && len(rule.params) == 0 &&
+		(rule.paramPrefix != "" || rule.paramSep != "" || rule.maxParams > 0 || rule.maxParamSize > 0) {
+		err = errorf("\"param_prefix\", \"param_separator\", \"max_params\" and \"max_param_size\" " +
+			"require \"decode_params\"")
+	}
+	if err == nil && rule.ignoreCase {
+		foldRule(rule)
+	}
+	return
+}
+
 // parseBlock parses the advance brace-block form of a "cgi" configuration
 // directive
 func parseBlock(c *caddy.Controller) (rule ruleType, err error) {
@@ -179,10 +864,8 @@ func parseBlock(c *caddy.Controller) (rule ruleType, err error) {
 				args := c.RemainingArgs()
 				err = parseToken(val, &rule, args, &loop)
 			}
-			if len(rule.matches) == 0 {
-				err = errorf("block must contain at least one \"match\" subdirective")
-			} else if rule.exe == "" {
-				err = errorf("block must contain an \"exec\" subdirective")
+			if err == nil {
+				err = checkRule(&rule)
 			}
 		} else {
 			err = errorf("expecting \"{\", got \"%s\"", c.Val())
@@ -193,8 +876,14 @@ func parseBlock(c *caddy.Controller) (rule ruleType, err error) {
 	return
 }
 
-// cgiParse parses one or more "cgi" configuration directives
-func cgiParse(c *caddy.Controller) (rules []ruleType, err error) {
+// cgiParse parses one or more "cgi" configuration directives. The rules, in
+// the order in which they are tried, and handler-wide settings ("cgi metrics
+// path", "cgi tracing endpoint", "cgi request_id [header]", "cgi order mode")
+// are returned, along with an index of the rules, in a handler that lacks only
+// its root and next handler. Rules that can never be applied are reported in
+// the log.
+func cgiParse(c *caddy.Controller) (hnd handlerType, err error) {
+	var orderSet bool
 	for err == nil && c.Next() {
 		val := c.Val()
 		args := c.RemainingArgs()
@@ -205,10 +894,60 @@ func cgiParse(c *caddy.Controller) (rules []ruleType, err error) {
 				var rule ruleType
 				rule, err = parseBlock(c)
 				if err == nil {
-					rules = append(rules, rule)
+					hnd.rules = append(hnd.rules, rule)
+				}
+			case len(args) == 2 && args[0] == "metrics": // metrics endpoint
+				if hnd.metricsPath == "" {
+					hnd.metricsPath = args[1]
+				} else {
+					err = errorf("\"cgi metrics\" may only be specified once")
+				}
+			case len(args) == 2 && args[0] == "tracing": // OTLP trace endpoint
+				if hnd.tracer == nil {
+					hnd.tracer = otlpExporterGet(args[1])
+				} else {
+					err = errorf("\"cgi tracing\" may only be specified once")
+				}
+			case len(args) == 2 && args[0] == "order": // rule ordering
+				switch {
+				case orderSet:
+					err = errorf("\"cgi order\" may only be specified once")
+				case args[1] == "config": // default
+				case args[1] == "specificity":
+					hnd.specific = true
+				default:
+					err = errorf("expecting \"config\" or \"specificity\" to follow \"cgi order\", got \"%s\"", args[1])
+				}
+				orderSet = true
+			case len(args) == 3 && args[0] == "cgi_bin": // script directory
+				var rule ruleType
+				err = parseCgiBin(&rule, args[1:])
+				if err == nil {
+					hnd.rules = append(hnd.rules, rule)
+				}
+			case len(args) == 3 && args[0] == "userdir": // per-user script directories
+				var rule ruleType
+				err = parseUserdir(&rule, args[1:])
+				if err == nil {
+					hnd.rules = append(hnd.rules, rule)
+				}
+			case len(args) >= 3 && args[0] == "handler": // extension handler
+				var rule ruleType
+				err = parseHandler(&rule, args[1:])
+				if err == nil {
+					hnd.rules = append(hnd.rules, rule)
+				}
+			case len(args) >= 1 && len(args) <= 2 && args[0] == "request_id": // request IDs
+				if hnd.requestIDHeader == "" {
+					hnd.requestIDHeader = requestIDDefaultHeader
+					if len(args) == 2 {
+						hnd.requestIDHeader = http.CanonicalHeaderKey(args[1])
+					}
+				} else {
+					err = errorf("\"cgi request_id\" may only be specified once")
 				}
 			case len(args) >= 2: // simple one-line syntax: one match, exe, args
-				rules = append(rules, ruleType{
+				hnd.rules = append(hnd.rules, ruleType{
 					matches: []string{args[0]},
 					exe:     args[1],
 					args:    args[2:],
@@ -220,5 +959,10 @@ func cgiParse(c *caddy.Controller) (rules []ruleType, err error) {
 			err = errorf("expecting \"cgi\", got \"%s\"", val)
 		}
 	}
+	if err == nil {
+		sortRules(hnd.rules)
+		logShadowWarnings(hnd.rules, hnd.specific)
+		hnd.index = newRuleIndex(hnd.rules)
+	}
 	return
 }
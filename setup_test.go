@@ -258,6 +258,421 @@ cgi {
 }`,
 
 		`1:cgi /report/daily`,
+
+		`0:cgi {
+  match /report
+  exec /usr/local/bin/report
+  debug 127.0.0.1 ::1 192.168.0.0/16
+}`,
+
+		`1:cgi {
+  match /report
+  exec /usr/local/bin/report
+  debug localhost
+}`,
+
+		`1:cgi {
+  match /report
+  exec /usr/local/bin/report
+  debug
+  debug 10.0.0.0/8
+}`,
+
+		`0:cgi {
+  match /report
+  exec /usr/local/bin/report
+  timing_headers all
+}`,
+
+		`1:cgi {
+  match /report
+  exec /usr/local/bin/report
+  timing_headers some
+}`,
+
+		`0:cgi metrics /cgi-metrics
+cgi {
+  name report
+  match /report
+  exec /usr/local/bin/report
+}`,
+
+		`1:cgi metrics /cgi-metrics
+cgi metrics /more-metrics`,
+
+		`0:cgi tracing http://localhost:4318/v1/traces
+cgi /report /usr/local/bin/report`,
+
+		`1:cgi tracing http://localhost:4318/v1/traces
+cgi tracing http://localhost:4319/v1/traces`,
+
+		`0:cgi {
+  match_regexp ^/api/(?P<svc>[a-z]+)(?P<path_info>/.*)?$
+  exec /srv/{re.svc}/handler
+}`,
+
+		`1:cgi {
+  match_regexp ^/api/(?P<svc>[a-z]+
+  exec /srv/{re.svc}/handler
+}`,
+
+		`1:cgi {
+  match_regexp
+  exec /srv/handler
+}`,
+
+		`0:cgi {
+  match /api/*
+  methods GET POST
+  host api.example.com *.internal
+  header X-Api-Version 2
+  header Authorization
+  query format=json debug
+  exec /usr/local/bin/api
+}`,
+
+		`1:cgi {
+  match /api/*
+  methods
+  exec /usr/local/bin/api
+}`,
+
+		`1:cgi {
+  match /api/*
+  host api.[example.com
+  exec /usr/local/bin/api
+}`,
+
+		`1:cgi {
+  match /api/*
+  query =json
+  exec /usr/local/bin/api
+}`,
+
+		`0:cgi order specificity
+cgi {
+  match /report
+  priority -2
+  exec /usr/local/bin/report
+}`,
+
+		`1:cgi order newest`,
+
+		`1:cgi order config
+cgi order specificity`,
+
+		`1:cgi {
+  match /report
+  priority high
+  exec /usr/local/bin/report
+}`,
+
+		`1:cgi {
+  match /report
+  priority 1
+  priority 2
+  exec /usr/local/bin/report
+}`,
+
+		`0:cgi {
+  match /report/*.lua
+  ignore_case
+  exec /usr/local/bin/report
+}`,
+
+		`1:cgi {
+  match /report/*.lua
+  ignore_case yes
+  exec /usr/local/bin/report
+}`,
+
+		`0:cgi cgi_bin /cgi-bin /srv/cgi-bin`,
+
+		`0:cgi {
+  cgi_bin /cgi-bin/ /srv/cgi-bin
+  methods GET
+  pass_env HOME
+}`,
+
+		`1:cgi {
+  cgi_bin cgi-bin /srv/cgi-bin
+}`,
+
+		`1:cgi {
+  cgi_bin /cgi-bin /srv/cgi-bin
+  exec /usr/local/bin/report
+}`,
+
+		`1:cgi {
+  cgi_bin /cgi-bin
+}`,
+
+		`0:cgi handler .py /usr/bin/python3 -u`,
+
+		`0:cgi {
+  handler .py /usr/bin/python3
+  handler .pl /usr/bin/perl
+  except /vendor/*
+  env APP=1
+}`,
+
+		`1:cgi handler py /usr/bin/python3`,
+
+		`1:cgi {
+  handler .py /usr/bin/python3
+  match /app
+}`,
+
+		`1:cgi {
+  handler .py /usr/bin/python3
+  cgi_bin /cgi-bin /srv/cgi-bin
+}`,
+
+		`0:cgi {
+  cgi_bin /cgi-bin /srv/cgi-bin
+  index index.cgi index.py
+}`,
+
+		`0:cgi {
+  handler .py /usr/bin/python3
+  index index.py
+}`,
+
+		`1:cgi {
+  handler .py /usr/bin/python3
+  index
+}`,
+
+		`1:cgi {
+  handler .py /usr/bin/python3
+  index ../index.py
+}`,
+
+		`1:cgi {
+  match /app
+  exec /usr/local/bin/app
+  index index.py
+}`,
+
+		`0:cgi userdir /cgi-bin public_cgi`,
+
+		`0:cgi {
+  userdir /cgi-bin public_cgi
+  userdir_allow dev-*
+  userdir_deny dev-guest root
+  index index.cgi
+}`,
+
+		`1:cgi userdir cgi-bin public_cgi`,
+
+		`1:cgi {
+  userdir /cgi-bin ../shared
+}`,
+
+		`1:cgi {
+  userdir /cgi-bin public_cgi
+  cgi_bin /cgi-bin /srv/cgi-bin
+}`,
+
+		`1:cgi {
+  userdir_allow alice
+  match /app
+  exec /usr/local/bin/app
+}`,
+
+		`1:cgi {
+  userdir /cgi-bin public_cgi
+  userdir_deny [
+}`,
+
+		`0:cgi {
+  match /app
+  exec /usr/local/bin/app
+  fallthrough
+}`,
+
+		`0:cgi {
+  match /app
+  exec /usr/local/bin/app
+  fallthrough 404 410
+}`,
+
+		`1:cgi {
+  match /app
+  exec /usr/local/bin/app
+  fallthrough 4o4
+}`,
+
+		`1:cgi {
+  match /app
+  exec /usr/local/bin/app
+  fallthrough 404
+  fallthrough 410
+}`,
+
+		`0:cgi {
+  match /download/*
+  exec /usr/local/bin/download
+  sendfile /srv/files /srv/archive
+  accel_redirect /protected /srv/protected
+}`,
+
+		`1:cgi {
+  match /download/*
+  exec /usr/local/bin/download
+  sendfile
+}`,
+
+		`1:cgi {
+  match /download/*
+  exec /usr/local/bin/download
+  accel_redirect protected /srv/protected
+}`,
+
+		`0:cgi {
+  match /push
+  exec /usr/local/bin/push
+  nph
+}`,
+
+		`1:cgi {
+  match /push
+  exec /usr/local/bin/push
+  nph always
+}`,
+
+		`0:cgi {
+  match /upload
+  exec /usr/local/bin/upload
+  max_body_size 10M
+  spool_body 256K
+}`,
+
+		`0:cgi {
+  match /upload
+  exec /usr/local/bin/upload
+  spool_body
+}`,
+
+		`1:cgi {
+  match /upload
+  exec /usr/local/bin/upload
+  max_body_size 0
+}`,
+
+		`1:cgi {
+  match /upload
+  exec /usr/local/bin/upload
+  spool_body 1M 2M
+}`,
+
+		`0:cgi {
+  match /report
+  exec /usr/local/bin/report
+  max_response_size 100M
+}`,
+
+		`1:cgi {
+  match /report
+  exec /usr/local/bin/report
+  max_response_size large
+}`,
+
+		`0:cgi {
+  match /report
+  exec /usr/local/bin/report
+  timeout 30s
+  max_running 4
+}`,
+
+		`1:cgi {
+  match /report
+  exec /usr/local/bin/report
+  timeout 30
+}`,
+
+		`1:cgi {
+  match /report
+  exec /usr/local/bin/report
+  max_running 0
+}`,
+
+		`0:cgi {
+  match /upload
+  exec /usr/local/bin/upload
+  max_body_size 10M
+  decode_request_body
+}`,
+
+		`1:cgi {
+  match /upload
+  exec /usr/local/bin/upload
+  decode_request_body gzip
+}`,
+
+		`0:cgi {
+  match /upload
+  exec /usr/local/bin/upload
+  uploads json
+  max_upload_files 4
+  max_upload_size 20M
+}`,
+
+		`1:cgi {
+  match /upload
+  exec /usr/local/bin/upload
+  uploads xml
+}`,
+
+		`1:cgi {
+  match /upload
+  exec /usr/local/bin/upload
+  max_upload_files 4
+}`,
+
+		`0:cgi {
+  match /form
+  exec /usr/local/bin/form
+  decode_params form query
+  param_prefix CGI_
+  param_separator |
+  max_params 20
+  max_param_size 1K
+}`,
+
+		`1:cgi {
+  match /form
+  exec /usr/local/bin/form
+  decode_params header
+}`,
+
+		`1:cgi {
+  match /form
+  exec /usr/local/bin/form
+  decode_params
+  param_prefix web-
+}`,
+
+		`1:cgi {
+  match /form
+  exec /usr/local/bin/form
+  max_params 20
+}`,
+
+		`0:cgi request_id
+cgi /report /usr/local/bin/report`,
+
+		`0:cgi request_id X-Correlation-ID
+cgi /report /usr/local/bin/report`,
+
+		`1:cgi request_id
+cgi request_id X-Trace-ID`,
+
+		`1:cgi {
+  name report weekly
+  match /report
+  exec /usr/local/bin/report
+}`,
 	}
 
 	for j := 0; j < len(directiveList) && err == nil; j++ {
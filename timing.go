@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The timing of the phases that precede the response body (process launch,
+// first byte of output, end of response header) is known when the response
+// header is written and is reported in a Server-Timing header. The total
+// duration and CPU usage are only known after the process exits, so they are
+// reported in a Server-Timing trailer. The trailer is declared along with the
+// header and its value is replaced once the header has been written; see the
+// net/http ResponseWriter documentation for details.
+
+// timingMetric formats a single Server-Timing metric
+func timingMetric(name string, dur time.Duration, desc string) string {
+	ms := strconv.FormatFloat(float64(dur)/float64(time.Millisecond), 'f', 3, 64)
+	return sprintf("%s;dur=%s;desc=\"%s\"", name, ms, desc)
+}
+
+// setTimingHeaders adds the timing of the phases that precede the response
+// body to hdr. If all is true, X-CGI-* headers are included as well.
+func setTimingHeaders(hdr http.Header, run *runType, all bool) {
+	hdr.Add("Server-Timing", join([]string{
+		timingMetric("cgi-spawn", run.spawn, "CGI process launch"),
+		timingMetric("cgi-ttfb", run.ttfb, "CGI first byte"),
+		timingMetric("cgi-header", run.header, "CGI response header"),
+	}, ", "))
+	hdr.Add("Trailer", "Server-Timing")
+	if all {
+		hdr.Set("X-CGI-Spawn", run.spawn.String())
+		hdr.Set("X-CGI-TTFB", run.ttfb.String())
+		hdr.Set("X-CGI-Header", run.header.String())
+		hdr.Add("Trailer", "X-CGI-Duration, X-CGI-User-CPU, X-CGI-Sys-CPU, X-CGI-Exit-Code, X-CGI-Max-RSS")
+	}
+}
+
+// setTimingTrailers assigns the total duration and CPU usage of the completed
+// execution to the trailers declared by setTimingHeaders. hdr must be obtained
+// after the response header has been written. If all is true, X-CGI-*
+// trailers are assigned as well.
+func setTimingTrailers(hdr http.Header, run *runType, all bool) {
+	if state := run.state; state != nil {
+		user := state.UserTime()
+		sys := state.SystemTime()
+		hdr.Set("Server-Timing", join([]string{
+			timingMetric("cgi-total", run.duration, "CGI total"),
+			timingMetric("cgi-cpu", user+sys, "CGI CPU"),
+		}, ", "))
+		if all {
+			hdr.Set("X-CGI-Duration", run.duration.String())
+			hdr.Set("X-CGI-User-CPU", user.String())
+			hdr.Set("X-CGI-Sys-CPU", sys.String())
+			hdr.Set("X-CGI-Exit-Code", strconv.Itoa(state.ExitCode()))
+			if rss := processMaxRSS(state); rss > 0 {
+				hdr.Set("X-CGI-Max-RSS", strconv.FormatInt(rss, 10))
+			}
+		}
+	}
+}
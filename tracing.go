@@ -0,0 +1,367 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each CGI execution can be recorded as a span in an OpenTelemetry trace. The
+// W3C trace context of the incoming request, if any, is continued; otherwise
+// a new trace is started. The context of the execution span is passed to the
+// CGI process in the TRACEPARENT and TRACESTATE environment variables so that
+// the script can record spans of its own. Completed spans are sent to an
+// exporter; the OTLP exporter delivers them as JSON over HTTP.
+
+const (
+	otlpBatchMax   = 64              // maximum number of spans per export request
+	otlpQueueMax   = 2048            // spans beyond this are dropped
+	otlpInterval   = 2 * time.Second // maximum time a span waits for export
+	otlpTimeout    = 10 * time.Second
+	otlpScopeName  = "github.com/jung-kurt/caddy-cgi"
+	otlpSpanServer = 2 // SPAN_KIND_SERVER
+	otlpStatusOk   = 1 // STATUS_CODE_OK
+	otlpStatusErr  = 2 // STATUS_CODE_ERROR
+)
+
+// attrType is a span attribute; val is a string, int64 or float64
+type attrType struct {
+	key string
+	val interface{}
+}
+
+// spanType describes a single CGI execution in a trace
+type spanType struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte // zero if span is the root of its trace
+	sampled    bool
+	traceState string
+	name       string
+	start, end time.Time
+	attrs      []attrType
+	failed     bool
+	statusMsg  string
+}
+
+// spanExporter receives completed spans
+type spanExporter interface {
+	export(span spanType)
+}
+
+// randomFill fills buf with random bytes, guaranteeing that at least one of
+// them is non-zero as required for trace and span identifiers
+func randomFill(buf []byte) {
+	for isZero(buf) {
+		rand.Read(buf)
+	}
+}
+
+// isZero returns true if every byte of buf is zero
+func isZero(buf []byte) (zero bool) {
+	zero = true
+	for j := 0; j < len(buf) && zero; j++ {
+		zero = buf[j] == 0
+	}
+	return
+}
+
+// parseTraceparent parses a W3C traceparent header value. ok is false if the
+// value is missing or malformed.
+func parseTraceparent(str string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(trim(str), "-")
+	if len(parts) >= 4 && len(parts[0]) == 2 && parts[0] != "ff" && len(parts[1]) == 32 &&
+		len(parts[2]) == 16 && len(parts[3]) == 2 && (parts[0] != "00" || len(parts) == 4) {
+		_, err1 := hex.Decode(traceID[:], []byte(parts[1]))
+		_, err2 := hex.Decode(parentID[:], []byte(parts[2]))
+		flags, err3 := hex.DecodeString(parts[3])
+		if err1 == nil && err2 == nil && err3 == nil && !isZero(traceID[:]) && !isZero(parentID[:]) {
+			sampled = flags[0]&1 == 1
+			ok = true
+		}
+	}
+	return
+}
+
+// startSpan begins a span for the specified request, continuing the request's
+// trace if it carries a valid traceparent header
+func startSpan(r *http.Request, name string) (span spanType) {
+	var ok bool
+	span.traceID, span.parentID, span.sampled, ok = parseTraceparent(r.Header.Get("Traceparent"))
+	if ok {
+		span.traceState = r.Header.Get("Tracestate")
+	} else {
+		randomFill(span.traceID[:])
+		span.parentID = [8]byte{}
+		span.sampled = true
+	}
+	randomFill(span.spanID[:])
+	span.name = name
+	span.start = time.Now()
+	return
+}
+
+// traceparent returns the W3C traceparent value that identifies span as the
+// parent of spans recorded by the CGI process
+func (span *spanType) traceparent() string {
+	flags := "00"
+	if span.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(span.traceID[:]) + "-" + hex.EncodeToString(span.spanID[:]) + "-" + flags
+}
+
+// traceEnv returns the environment entries that convey the context of span to
+// the CGI process
+func (span *spanType) traceEnv() (env []string) {
+	env = append(env, "TRACEPARENT="+span.traceparent())
+	if span.traceState != "" {
+		env = append(env, "TRACESTATE="+span.traceState)
+	}
+	return
+}
+
+// finish completes span with the details of a CGI execution
+func (span *spanType) finish(r *http.Request, rule ruleType, cgiHnd hostType, run *runType) {
+	span.end = time.Now()
+	span.attrs = append(span.attrs,
+		attrType{"http.method", r.Method},
+		attrType{"http.target", r.URL.RequestURI()},
+		attrType{"http.status_code", int64(run.status)},
+		attrType{"cgi.rule", ruleLabel(rule)},
+		attrType{"cgi.exec", cgiHnd.path},
+		attrType{"cgi.spawn_ms", run.spawn.Seconds() * 1000},
+		attrType{"cgi.ttfb_ms", run.ttfb.Seconds() * 1000},
+		attrType{"cgi.duration_ms", run.duration.Seconds() * 1000},
+	)
+	if state := run.state; state != nil {
+		span.attrs = append(span.attrs,
+			attrType{"cgi.pid", int64(state.Pid())},
+			attrType{"cgi.exit_code", int64(state.ExitCode())},
+		)
+		if sig := processSignal(state); sig != "" {
+			span.attrs = append(span.attrs, attrType{"cgi.signal", sig})
+		}
+	}
+	span.failed = run.failed()
+	if run.err != nil {
+		span.statusMsg = run.err.Error()
+	} else if run.state != nil && !run.state.Success() {
+		span.statusMsg = run.state.String()
+	}
+}
+
+// otlpExporter sends spans in batches to an OTLP/HTTP collector endpoint
+// using the JSON encoding
+type otlpExporter struct {
+	endpoint string
+	queue    chan spanType
+	client   *http.Client
+	done     chan struct{} // closed to stop delivery
+	stopped  chan struct{} // closed when delivery has stopped
+	once     sync.Once
+}
+
+// otlpExporters holds one exporter per endpoint so that configuration reloads
+// do not start additional delivery goroutines
+var otlpExporters = struct {
+	sync.Mutex
+	mp map[string]*otlpExporter
+}{mp: make(map[string]*otlpExporter)}
+
+// otlpExporterGet returns the exporter for the specified endpoint, starting
+// it if necessary
+func otlpExporterGet(endpoint string) (exp *otlpExporter) {
+	otlpExporters.Lock()
+	exp = otlpExporters.mp[endpoint]
+	if exp == nil {
+		exp = &otlpExporter{
+			endpoint: endpoint,
+			queue:    make(chan spanType, otlpQueueMax),
+			client:   &http.Client{Timeout: otlpTimeout},
+			done:     make(chan struct{}),
+			stopped:  make(chan struct{}),
+		}
+		otlpExporters.mp[endpoint] = exp
+		go exp.run()
+	}
+	otlpExporters.Unlock()
+	return
+}
+
+func (exp *otlpExporter) export(span spanType) {
+	if span.sampled {
+		select {
+		case exp.queue <- span:
+		default: // queue is full; drop span rather than delay response
+		}
+	}
+}
+
+// close delivers the spans that are waiting and stops the exporter. A later
+// request for the same endpoint starts a new exporter.
+func (exp *otlpExporter) close() {
+	exp.once.Do(func() {
+		otlpExporters.Lock()
+		if otlpExporters.mp[exp.endpoint] == exp {
+			delete(otlpExporters.mp, exp.endpoint)
+		}
+		otlpExporters.Unlock()
+		close(exp.done)
+	})
+	<-exp.stopped
+}
+
+// run delivers queued spans until the exporter is closed
+func (exp *otlpExporter) run() {
+	var batch []spanType
+	tick := time.NewTicker(otlpInterval)
+	loop := true
+	for loop {
+		select {
+		case span := <-exp.queue:
+			batch = append(batch, span)
+			if len(batch) >= otlpBatchMax {
+				exp.send(batch)
+				batch = nil
+			}
+		case <-tick.C:
+			if len(batch) > 0 {
+				exp.send(batch)
+				batch = nil
+			}
+		case <-exp.done:
+			for len(exp.queue) > 0 {
+				batch = append(batch, <-exp.queue)
+			}
+			if len(batch) > 0 {
+				exp.send(batch)
+			}
+			loop = false
+		}
+	}
+	tick.Stop()
+	close(exp.stopped)
+}
+
+// send posts a batch of spans to the collector
+func (exp *otlpExporter) send(batch []spanType) {
+	var res *http.Response
+	buf, err := otlpEncode(batch)
+	if err == nil {
+		res, err = exp.client.Post(exp.endpoint, "application/json", bytes.NewReader(buf))
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode/100 != 2 {
+				err = errorf("collector responded with %s", res.Status)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("[ERROR] cgi: exporting %d spans to %s: %s", len(batch), exp.endpoint, err)
+	}
+}
+
+// otlpEncode encodes spans as an OTLP ExportTraceServiceRequest in JSON
+func otlpEncode(batch []spanType) ([]byte, error) {
+	type anyValue map[string]interface{}
+	type keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	type status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	type span struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		TraceState        string     `json:"traceState,omitempty"`
+		Name              string     `json:"name"`
+		Kind              int        `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []keyValue `json:"attributes"`
+		Status            status     `json:"status"`
+	}
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []span `json:"spans"`
+	}
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []keyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	type request struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+
+	value := func(val interface{}) (av anyValue) {
+		switch v := val.(type) {
+		case int64:
+			av = anyValue{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			av = anyValue{"doubleValue": v}
+		default:
+			av = anyValue{"stringValue": sprintf("%v", v)}
+		}
+		return
+	}
+
+	var ss scopeSpans
+	ss.Scope.Name = otlpScopeName
+	for _, sp := range batch {
+		out := span{
+			TraceID:           hex.EncodeToString(sp.traceID[:]),
+			SpanID:            hex.EncodeToString(sp.spanID[:]),
+			TraceState:        sp.traceState,
+			Name:              sp.name,
+			Kind:              otlpSpanServer,
+			StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+			Status:            status{Code: otlpStatusOk},
+		}
+		if !isZero(sp.parentID[:]) {
+			out.ParentSpanID = hex.EncodeToString(sp.parentID[:])
+		}
+		for _, attr := range sp.attrs {
+			out.Attributes = append(out.Attributes, keyValue{Key: attr.key, Value: value(attr.val)})
+		}
+		if sp.failed {
+			out.Status = status{Code: otlpStatusErr, Message: sp.statusMsg}
+		}
+		ss.Spans = append(ss.Spans, out)
+	}
+	var rs resourceSpans
+	rs.Resource.Attributes = []keyValue{{Key: "service.name", Value: value("caddy-cgi")}}
+	rs.ScopeSpans = []scopeSpans{ss}
+	return json.Marshal(request{ResourceSpans: []resourceSpans{rs}})
+}
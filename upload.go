@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2020 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A rule may have multipart/form-data request bodies received by the plugin
+// rather than by the script. Each file part is saved in a temporary directory
+// that is created for the request and removed after the script exits. The
+// script is told about the files and given the ordinary form fields in one of
+// two ways. In the "env" manner, each file is described by UPLOAD_* variables
+// and the fields make up a URL-encoded body on standard input. In the "json"
+// manner, a JSON manifest of both is written to standard input.
+
+const (
+	uploadFilesDefault = 10       // files permitted per request, unless the rule specifies otherwise
+	uploadSizeDefault  = 32 << 20 // size permitted per file, unless the rule specifies otherwise
+	uploadFieldMax     = 1 << 20  // total size of ordinary form fields held in memory
+)
+
+// errTooManyFiles is reported when a request uploads more files than its rule
+// permits
+var errTooManyFiles = errors.New("too many files uploaded")
+
+// uploadFileType describes one uploaded file for the script
+type uploadFileType struct {
+	Field       string `json:"field"`        // name of form field
+	Filename    string `json:"filename"`     // name of file as given by client
+	ContentType string `json:"content_type"` // media type as given by client
+	Path        string `json:"path"`         // location of saved file
+	Size        int64  `json:"size"`         // length of file in bytes
+}
+
+// uploadManifestType is written to standard input in the "json" manner
+type uploadManifestType struct {
+	Fields url.Values       `json:"fields"`
+	Files  []uploadFileType `json:"files"`
+}
+
+// uploadBoundary returns the boundary of the body of req if it is
+// multipart/form-data
+func uploadBoundary(req *http.Request) (boundary string, ok bool) {
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err == nil && mediaType == "multipart/form-data" {
+		boundary, ok = params["boundary"]
+	}
+	return
+}
+
+// cleanEnvStr removes NUL characters, which cannot appear in environment
+// variables, from str
+func cleanEnvStr(str string) string {
+	return strings.Replace(str, "\x00", "", -1)
+}
+
+// saveUpload copies the file in part to pathStr, with the size limit of the
+// rule, and records it in list
+func (hst hostType) saveUpload(part *multipart.Part, pathStr string, list *[]uploadFileType) (err error) {
+	var fl *os.File
+	max := hst.maxUpload
+	if max <= 0 {
+		max = uploadSizeDefault
+	}
+	fl, err = os.OpenFile(pathStr, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		var size int64
+		size, err = io.Copy(fl, &limitReader{rdr: part, max: max, err: errBodyTooLarge})
+		closeErr := fl.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = uploadOwner(pathStr, hst.attr)
+		}
+		*list = append(*list, uploadFileType{
+			Field:       cleanEnvStr(part.FormName()),
+			Filename:    cleanEnvStr(part.FileName()),
+			ContentType: cleanEnvStr(part.Header.Get("Content-Type")),
+			Path:        pathStr,
+			Size:        size,
+		})
+	}
+	return
+}
+
+// receiveUploads reads the multipart/form-data body in src, saving file parts
+// in a new temporary directory and keeping ordinary fields in memory. The
+// returned body presents the files and fields to the script in the manner of
+// the rule. The caller must close body, even if an error is returned.
+func (hst hostType) receiveUploads(src io.Reader, boundary string) (body bodyType, err error) {
+	var part *multipart.Part
+	files := []uploadFileType{}
+	fields := url.Values{}
+	fieldSize := int64(0)
+	maxFiles := hst.maxFiles
+	if maxFiles <= 0 {
+		maxFiles = uploadFilesDefault
+	}
+	body.size = -1
+	body.dir, err = ioutil.TempDir("", "cgi-upload-")
+	if err == nil {
+		err = uploadOwner(body.dir, hst.attr)
+	}
+	mr := multipart.NewReader(src, boundary)
+	for err == nil {
+		part, err = mr.NextPart()
+		if err == nil {
+			switch {
+			case part.FormName() == "":
+			case part.FileName() == "":
+				var buf bytes.Buffer
+				var n int64
+				n, err = io.CopyN(&buf, part, uploadFieldMax-fieldSize+1)
+				if err == io.EOF {
+					err = nil
+				} else if err == nil {
+					err = errBodyTooLarge
+				}
+				fieldSize += n
+				name := cleanEnvStr(part.FormName())
+				fields[name] = append(fields[name], cleanEnvStr(buf.String()))
+			case len(files) >= maxFiles:
+				err = errTooManyFiles
+			default:
+				err = hst.saveUpload(part, filepath.Join(body.dir, strconv.Itoa(len(files))), &files)
+			}
+			part.Close()
+		}
+	}
+	if err == io.EOF {
+		var data []byte
+		err = nil
+		if hst.uploads == "json" {
+			data, err = json.Marshal(uploadManifestType{Fields: fields, Files: files})
+			body.ctype = "application/json"
+		} else {
+			data = []byte(fields.Encode())
+			body.ctype = "application/x-www-form-urlencoded"
+			body.env = append(body.env, "UPLOAD_COUNT="+strconv.Itoa(len(files)))
+			for j, fl := range files {
+				pfx := "UPLOAD_" + strconv.Itoa(j) + "_"
+				body.env = append(body.env,
+					pfx+"FIELD="+fl.Field,
+					pfx+"FILENAME="+fl.Filename,
+					pfx+"CONTENT_TYPE="+fl.ContentType,
+					pfx+"PATH="+fl.Path,
+					pfx+"SIZE="+strconv.FormatInt(fl.Size, 10))
+			}
+		}
+		body.rdr = bytes.NewReader(data)
+		body.size = int64(len(data))
+	}
+	return
+}
@@ -0,0 +1,23 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package cgi
+
+import (
+	"os/user"
+	"runtime"
+	"syscall"
+)
+
+// userAttr returns an error on platforms that cannot run a process as another
+// user
+func userAttr(u *user.User, fileStr string) (attr *syscall.SysProcAttr, err error) {
+	err = errorf("cannot run scripts of %s on %s", u.Username, runtime.GOOS)
+	return
+}
+
+// uploadOwner does nothing on platforms that cannot run a process as another
+// user
+func uploadOwner(pathStr string, attr *syscall.SysProcAttr) (err error) {
+	return
+}
@@ -0,0 +1,89 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package cgi
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ownerCheck returns an error if the file described by info, found at
+// pathStr, is a symbolic link, does not belong to uid, or can be written by
+// its group or others
+func ownerCheck(pathStr string, info os.FileInfo, uid uint64) (err error) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	switch {
+	case !ok:
+		err = errorf("cannot determine owner of %s", pathStr)
+	case info.Mode()&os.ModeSymlink != 0:
+		err = errorf("%s is a symbolic link", pathStr)
+	case uint64(st.Uid) != uid:
+		err = errorf("%s is not owned by uid %d", pathStr, uid)
+	case info.Mode().Perm()&0022 != 0:
+		err = errorf("%s is writable by group or others", pathStr)
+	}
+	return
+}
+
+// userAttr returns the process attributes with which to run the script
+// fileStr as user u. An error is returned if u is root, or if the script or
+// any directory between it and the user's home directory, inclusive, fails
+// ownerCheck.
+func userAttr(u *user.User, fileStr string) (attr *syscall.SysProcAttr, err error) {
+	var uid, gid uint64
+	uid, err = strconv.ParseUint(u.Uid, 10, 32)
+	if err == nil {
+		gid, err = strconv.ParseUint(u.Gid, 10, 32)
+		if err == nil && uid == 0 {
+			err = errorf("refusing to run scripts of %s as root", u.Username)
+		}
+	}
+	homeStr := filepath.Clean(u.HomeDir)
+	if err == nil && !strings.HasPrefix(fileStr, homeStr+string(filepath.Separator)) {
+		err = errorf("%s is not beneath %s", fileStr, homeStr)
+	}
+	pathStr := fileStr
+	done := false
+	for !done && err == nil {
+		var info os.FileInfo
+		done = pathStr == homeStr
+		if pathStr == homeStr {
+			// the home directory itself may be reached by way of a link
+			info, err = os.Stat(pathStr)
+		} else {
+			info, err = os.Lstat(pathStr)
+		}
+		if err == nil {
+			err = ownerCheck(pathStr, info, uid)
+		}
+		pathStr = filepath.Dir(pathStr)
+	}
+	if err == nil {
+		attr = &syscall.SysProcAttr{}
+		if uint64(os.Getuid()) != uid || uint64(os.Getgid()) != gid {
+			attr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+			ids, _ := u.GroupIds()
+			for _, str := range ids {
+				id, idErr := strconv.ParseUint(str, 10, 32)
+				if idErr == nil {
+					attr.Credential.Groups = append(attr.Credential.Groups, uint32(id))
+				}
+			}
+		}
+	}
+	return
+}
+
+// uploadOwner gives the uploaded file or directory at pathStr to the user
+// named in attr, if any, so that a script run as that user can read it
+func uploadOwner(pathStr string, attr *syscall.SysProcAttr) (err error) {
+	if attr != nil && attr.Credential != nil {
+		err = os.Lchown(pathStr, int(attr.Credential.Uid), int(attr.Credential.Gid))
+	}
+	return
+}
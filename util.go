@@ -20,12 +20,87 @@ func unused(args ...interface{}) {
 func printRules(rules []ruleType) {
 	for j, r := range rules {
 		printf("Rule %d\n", j)
+		if r.name != "" {
+			printf("  Name: %s\n", r.name)
+		}
+		if r.priority != 0 {
+			printf("  Priority: %d\n", r.priority)
+		}
 		for k, match := range r.matches {
 			printf("  Match %d: %s\n", k, match)
 		}
+		for k, re := range r.regexps {
+			printf("  Match regexp %d: %s\n", k, re)
+		}
 		for k, except := range r.exceptions {
 			printf("  Except %d: %s\n", k, except)
 		}
+		if len(r.methods) > 0 {
+			printf("  Methods: %s\n", join(r.methods, " "))
+		}
+		for k, host := range r.hosts {
+			printf("  Host %d: %s\n", k, host)
+		}
+		for k, cond := range r.headers {
+			printf("  Header %d: %s\n", k, join(cond, " "))
+		}
+		for k, cond := range r.queries {
+			printf("  Query %d: %s\n", k, join(cond, "="))
+		}
+		if r.ignoreCase {
+			printf("  Ignore case: true\n")
+		}
+		if r.binDir != "" {
+			printf("  CGI bin: %s %s\n", r.binPrefix, r.binDir)
+		}
+		for k, ext := range r.exts {
+			printf("  Handler %d: %s %s\n", k, ext.ext, trim(ext.exe+" "+join(ext.args, " ")))
+		}
+		if r.userDir != "" {
+			printf("  User dir: %s %s\n", r.userPrefix, r.userDir)
+		}
+		if len(r.userAllow) > 0 {
+			printf("  User allow: %s\n", join(r.userAllow, " "))
+		}
+		if len(r.userDeny) > 0 {
+			printf("  User deny: %s\n", join(r.userDeny, " "))
+		}
+		if len(r.indexes) > 0 {
+			printf("  Index: %s\n", join(r.indexes, " "))
+		}
+		if r.fallThrough {
+			printf("  Fallthrough: %v\n", r.fallStatuses)
+		}
+		if len(r.sendDirs) > 0 {
+			printf("  Sendfile: %s\n", join(r.sendDirs, " "))
+		}
+		for k, accel := range r.accels {
+			printf("  Accel redirect %d: %s %s\n", k, accel[0], accel[1])
+		}
+		if r.nph {
+			printf("  NPH: true\n")
+		}
+		if r.maxBody > 0 {
+			printf("  Max body size: %d\n", r.maxBody)
+		}
+		if r.maxResponse > 0 {
+			printf("  Max response size: %d\n", r.maxResponse)
+		}
+		if r.timeout > 0 {
+			printf("  Timeout: %s\n", r.timeout)
+		}
+		if r.maxRunning > 0 {
+			printf("  Max running: %d\n", r.maxRunning)
+		}
+		if r.spool {
+			printf("  Spool body: %d\n", r.spoolMem)
+		}
+		if r.decodeBody {
+			printf("  Decode body: true\n")
+		}
+		if r.uploads != "" {
+			printf("  Uploads: %s (files %d, size %d)\n", r.uploads, r.uploadFiles, r.uploadMax)
+		}
 		printf("  Exe: %s\n", r.exe)
 		printf("  Pass all: %v\n", r.passAll)
 		printf("  Inspect: %v\n", r.inspect)
@@ -41,5 +116,12 @@ func printRules(rules []ruleType) {
 		for k, str := range r.emptyEnvs {
 			printf("  Empty env %d: %s\n", k, str)
 		}
+		if len(r.params) > 0 {
+			printf("  Decode params: %s (prefix [%s], count %d, size %d)\n",
+				join(r.params, " "), r.paramPrefix, r.maxParams, r.maxParamSize)
+		}
+		for k, ipNet := range r.debugNets {
+			printf("  Debug %d: %s\n", k, ipNet)
+		}
 	}
 }